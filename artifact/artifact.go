@@ -33,6 +33,15 @@ type Artifact interface {
 	// Close an artifact and disconnect from its sender.
 	Disconnect()
 
+	// Get the number of hops that an artifact may still travel.
+	HopLimit() uint8
+
+	// Get the number of hops that an artifact has travelled.
+	Hops() uint8
+
+	// Get the most recent relays of an artifact, ordered from oldest to newest.
+	Path() []Relay
+
 	// Get the purported size of an artifact.
 	Size() uint32
 
@@ -47,11 +56,24 @@ type artifact struct {
 	checksum    [32]byte
 	closer      chan int
 	compression bool
+	hopLimit    uint8
+	hops        uint8
+	path        []Relay
 	reader      io.Reader
 	size        uint32
 	timestamp   time.Time
 }
 
+// A compact identifier of a relay.
+type Relay [8]byte
+
+// Create a compact identifier from the identifier of a relay.
+func NewRelay(id string) (relay Relay) {
+	hash := sha256.Sum256([]byte(id))
+	copy(relay[:], hash[:])
+	return
+}
+
 // Get the purported checksum of an artifact.
 func (artifact *artifact) Checksum() [32]byte {
 	return artifact.checksum
@@ -73,6 +95,23 @@ func (artifact *artifact) Disconnect() {
 	artifact.closer <- 1
 }
 
+// Get the number of hops that an artifact may still travel.
+func (artifact *artifact) HopLimit() uint8 {
+	return artifact.hopLimit
+}
+
+// Get the number of hops that an artifact has travelled.
+func (artifact *artifact) Hops() uint8 {
+	return artifact.hops
+}
+
+// Get the most recent relays of an artifact, ordered from oldest to newest.
+func (artifact *artifact) Path() []Relay {
+	path := make([]Relay, len(artifact.path))
+	copy(path, artifact.path)
+	return path
+}
+
 // Get the purported size of an artifact.
 func (artifact *artifact) Size() uint32 {
 	return artifact.size
@@ -95,16 +134,43 @@ func (artifact *artifact) Read(data []byte) (n int, err error) {
 
 // Create an artifact.
 func New(reader io.Reader, checksum [32]byte, compression bool, size uint32, timestamp time.Time) Artifact {
+	return NewWithRoute(reader, checksum, compression, size, timestamp, 0, 0, nil)
+}
+
+// Create an artifact that has travelled a number of hops through the given
+// relays and may travel a number of hops further.
+func NewWithRoute(reader io.Reader, checksum [32]byte, compression bool, size uint32, timestamp time.Time, hops uint8, hopLimit uint8, path []Relay) Artifact {
 	return &artifact{
 		checksum,
 		make(chan int, 1),
 		compression,
+		hopLimit,
+		hops,
+		path,
 		reader,
 		size,
 		timestamp.UTC(),
 	}
 }
 
+// This type restricts the number of hops that an artifact may travel.
+type scoped struct {
+	Artifact
+	hopLimit uint8
+}
+
+// Get the number of hops that an artifact may still travel.
+func (artifact *scoped) HopLimit() uint8 {
+	return artifact.hopLimit
+}
+
+// Restrict the number of hops that an artifact may travel. This is useful for
+// keeping an artifact within the local neighbourhood of its sender. A limit of
+// zero lets the sender choose the limit.
+func WithHopLimit(artifact Artifact, hopLimit uint8) Artifact {
+	return &scoped{artifact, hopLimit}
+}
+
 // Create an artifact from a byte slice.
 func FromBytes(data []byte, compression bool) (Artifact, error) {
 
@@ -191,6 +257,50 @@ func EncodeMetadata(artifact Artifact) (metadata [45]byte) {
 
 }
 
+// Encode the route of an artifact.
+func EncodeRoute(hops uint8, hopLimit uint8, path []Relay) []byte {
+
+	if len(path) > 255 {
+		path = path[len(path)-255:]
+	}
+
+	route := make([]byte, 3, 3+len(path)*len(Relay{}))
+	route[0] = hops
+	route[1] = hopLimit
+	route[2] = uint8(len(path))
+	for i := range path {
+		route = append(route, path[i][:]...)
+	}
+
+	return route
+
+}
+
+// Decode the route of an artifact from a reader.
+func DecodeRoute(reader io.Reader) (hops uint8, hopLimit uint8, path []Relay, err error) {
+
+	var header [3]byte
+
+	_, err = io.ReadFull(reader, header[:])
+	if err != nil {
+		return
+	}
+
+	hops = header[0]
+	hopLimit = header[1]
+
+	path = make([]Relay, header[2])
+	for i := range path {
+		_, err = io.ReadFull(reader, path[i][:])
+		if err != nil {
+			return
+		}
+	}
+
+	return
+
+}
+
 // Decode the metadata of an artifact.
 func DecodeMetadata(metadata [45]byte) (checksum [32]byte, compression bool, size uint32, timestamp time.Time) {
 
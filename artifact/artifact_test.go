@@ -65,3 +65,49 @@ func TestEncodeDecodeMetadata(test *testing.T) {
 	}
 
 }
+
+// Show that we can encode and decode the route of an artifact.
+func TestEncodeDecodeRoute(test *testing.T) {
+
+	path := []Relay{NewRelay("foo"), NewRelay("bar")}
+
+	route := EncodeRoute(3, 5, path)
+
+	hops, hopLimit, decoded, err := DecodeRoute(bytes.NewReader(route))
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	if hops != 3 {
+		test.Fatal("Unexpected hops!", hops)
+	}
+
+	if hopLimit != 5 {
+		test.Fatal("Unexpected hop limit!", hopLimit)
+	}
+
+	if len(decoded) != len(path) || decoded[0] != path[0] || decoded[1] != path[1] {
+		test.Fatal("Unexpected path!", decoded)
+	}
+
+}
+
+// Show that we can restrict the number of hops that an artifact may travel.
+func TestWithHopLimit(test *testing.T) {
+
+	artifact, err := FromBytes([]byte("This is a test."), false)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	scoped := WithHopLimit(artifact, 2)
+
+	if scoped.HopLimit() != 2 {
+		test.Fatal("Unexpected hop limit!", scoped.HopLimit())
+	}
+
+	if scoped.Checksum() != artifact.Checksum() {
+		test.Fatal("Unexpected checksum!", scoped.Checksum())
+	}
+
+}
@@ -18,6 +18,14 @@ import (
 	"time"
 )
 
+type Ring struct {
+	MinLatency int64
+	MaxLatency int64
+	Latency    int64
+	Members    []string
+	Latencies  []int64
+}
+
 type Report struct {
 	Addrs           []string
 	ClusterID       int
@@ -27,6 +35,7 @@ type Report struct {
 	ProcessID       int
 	InboundStreams  []string
 	OutboundStreams []string
+	Rings           []Ring
 	Timestamp       int64
 	UserData        string
 	Version         string
@@ -84,6 +93,20 @@ func graph(reports map[string]Report, lock *sync.Mutex, ttl time.Duration) http.
 				continue
 			}
 
+			// Find the ring of each member.
+			occupancy := make([]int, len(report.Rings))
+			rings := make(map[string]int)
+			latencies := make(map[string]int64)
+			for i, ring := range report.Rings {
+				occupancy[i] = len(ring.Members)
+				for j, member := range ring.Members {
+					rings[member] = i
+					if j < len(ring.Latencies) {
+						latencies[member] = ring.Latencies[j]
+					}
+				}
+			}
+
 			nodes = append(nodes, map[string]interface{}{
 				"Addrs":           report.Addrs,
 				"ClusterID":       report.ClusterID,
@@ -93,15 +116,22 @@ func graph(reports map[string]Report, lock *sync.Mutex, ttl time.Duration) http.
 				"ProcessID":       report.ProcessID,
 				"InboundStreams":  len(report.InboundStreams),
 				"OutboundStreams": len(report.OutboundStreams),
+				"Rings":           occupancy,
 				"Timestamp":       report.Timestamp,
 				"UserData":        report.UserData,
 				"Version":         report.Version,
 			})
 
 			for _, stream := range append(report.InboundStreams, report.OutboundStreams...) {
+				ring, exists := rings[stream]
+				if !exists {
+					ring = -1
+				}
 				links = append(links, map[string]interface{}{
-					"source": report.NodeID,
-					"target": stream,
+					"source":  report.NodeID,
+					"target":  stream,
+					"ring":    ring,
+					"latency": latencies[stream],
 				})
 			}
 
@@ -379,6 +379,8 @@ var HTML = []byte(`<!DOCTYPE html>
 						d.InboundStreams +
 						'<br/>OutboundStreams: ' +
 						d.OutboundStreams +
+						'<br/>Rings: ' +
+						(d.Rings || []).join(' / ') +
 						'<br/>Version: ' +
 						d.Version +
 						'</span>'
@@ -394,6 +396,7 @@ var HTML = []byte(`<!DOCTYPE html>
 					if (err) throw err;
 
 					var color = d3.scaleOrdinal(d3.schemeCategory20);
+					var ringColor = d3.scaleSequential(d3.interpolateCool).domain([0, 8]);
 
 					var link = svg
 						.append('g')
@@ -401,7 +404,8 @@ var HTML = []byte(`<!DOCTYPE html>
 						.selectAll('line')
 						.data(graph.links)
 						.enter()
-						.append('line');
+						.append('line')
+						.style('stroke', function(d) { return d.ring >= 0 ? ringColor(d.ring) : null; });
 
 					var node = svg
 						.append('g')
@@ -26,6 +26,14 @@ func (client *client) activateAnalytics() func() {
 
 	go func() {
 
+		type Ring struct {
+			MinLatency int64
+			MaxLatency int64
+			Latency    int64
+			Members    []string
+			Latencies  []int64
+		}
+
 		type Report struct {
 			Addrs           []string
 			ClusterID       int
@@ -35,6 +43,7 @@ func (client *client) activateAnalytics() func() {
 			ProcessID       int
 			InboundStreams  []string
 			OutboundStreams []string
+			Rings           []Ring
 			Timestamp       int64
 			UserData        string
 			Version         string
@@ -69,6 +78,18 @@ func (client *client) activateAnalytics() func() {
 			for _, stream := range client.streamstore.OutboundPeers() {
 				report.OutboundStreams = append(report.OutboundStreams, stream.Pretty())
 			}
+			for _, info := range client.Rings() {
+				ring := Ring{
+					MinLatency: int64(info.MinLatency),
+					MaxLatency: int64(info.MaxLatency),
+					Latency:    int64(info.Latency),
+				}
+				for _, member := range info.Members {
+					ring.Members = append(ring.Members, member.ID.Pretty())
+					ring.Latencies = append(ring.Latencies, int64(member.Latency))
+				}
+				report.Rings = append(report.Rings, ring)
+			}
 
 			// Encode it.
 			data, err := json.Marshal(&report)
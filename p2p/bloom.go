@@ -0,0 +1,86 @@
+/**
+ * File        : bloom.go
+ * Description : Bloom filter for artifact checksums.
+ * Copyright   : Copyright (c) 2017-2018 DFINITY Stiftung. All rights reserved.
+ * Maintainer  : Enzo Haussecker <enzo@dfinity.org>
+ * Stability   : Experimental
+ */
+
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// The number of bits allocated per element and the number of hash functions.
+// Together they yield a false positive rate of roughly one percent.
+const (
+	bloomBitsPerElement = 10
+	bloomHashFunctions  = 7
+)
+
+// This type represents a compact summary of a set of artifact checksums.
+type bloomFilter struct {
+	bits []byte
+	k    uint8
+}
+
+// Create a Bloom filter that can hold n elements.
+func newBloomFilter(n int) *bloomFilter {
+	return &bloomFilter{make([]byte, bloomFilterSize(n)-1), bloomHashFunctions}
+}
+
+// Calculate the encoded size of a Bloom filter that can hold n elements.
+func bloomFilterSize(n int) int {
+	size := (n*bloomBitsPerElement + 7) / 8
+	if size == 0 {
+		size = 1
+	}
+	return size + 1
+}
+
+// Derive the bit positions of a checksum. The checksum is already uniformly
+// distributed, so we can use double hashing over its leading bytes.
+func (filter *bloomFilter) positions(checksum [32]byte) []uint64 {
+	m := uint64(len(filter.bits)) * 8
+	h1 := binary.BigEndian.Uint64(checksum[0:8])
+	h2 := binary.BigEndian.Uint64(checksum[8:16]) | 1
+	result := make([]uint64, filter.k)
+	for i := range result {
+		result[i] = (h1 + uint64(i)*h2) % m
+	}
+	return result
+}
+
+// Add a checksum to the filter.
+func (filter *bloomFilter) add(checksum [32]byte) {
+	for _, j := range filter.positions(checksum) {
+		filter.bits[j/8] |= 1 << (j % 8)
+	}
+}
+
+// Check if a checksum may be in the filter.
+func (filter *bloomFilter) contains(checksum [32]byte) bool {
+	for _, j := range filter.positions(checksum) {
+		if filter.bits[j/8]&(1<<(j%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Encode the filter.
+func (filter *bloomFilter) encode() []byte {
+	return append([]byte{filter.k}, filter.bits...)
+}
+
+// Decode a filter.
+func decodeBloomFilter(data []byte) (*bloomFilter, error) {
+	if len(data) < 2 || data[0] == 0 {
+		return nil, errors.New("Invalid Bloom filter")
+	}
+	bits := make([]byte, len(data)-1)
+	copy(bits, data[1:])
+	return &bloomFilter{bits, data[0]}, nil
+}
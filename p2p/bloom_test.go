@@ -0,0 +1,74 @@
+/**
+ * File        : bloom_test.go
+ * Description : Unit tests.
+ * Copyright   : Copyright (c) 2017-2018 DFINITY Stiftung. All rights reserved.
+ * Maintainer  : Enzo Haussecker <enzo@dfinity.org>
+ * Stability   : Experimental
+ */
+
+package p2p
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"github.com/dfinity/go-revolver/util"
+)
+
+// Show that a Bloom filter survives encoding and has no false negatives.
+func TestBloomFilter(test *testing.T) {
+
+	const N = 1024
+
+	filter := newBloomFilter(N)
+	for i := 0; i < N; i++ {
+		data := util.EncodeBigEndianInt64(int64(i))
+		filter.add(sha256.Sum256(data[:]))
+	}
+
+	decoded, err := decodeBloomFilter(filter.encode())
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	// Verify that every member is reported.
+	for i := 0; i < N; i++ {
+		data := util.EncodeBigEndianInt64(int64(i))
+		if !decoded.contains(sha256.Sum256(data[:])) {
+			test.Fatal("False negative!", i)
+		}
+	}
+
+	// Verify that the false positive rate is reasonable.
+	positives := 0
+	for i := N; i < 2*N; i++ {
+		data := util.EncodeBigEndianInt64(int64(i))
+		if decoded.contains(sha256.Sum256(data[:])) {
+			positives++
+		}
+	}
+	if positives > N/20 {
+		test.Fatal("Too many false positives!", positives)
+	}
+
+}
+
+// Show that the summary of the reconciliation window must fit in the buffer
+// of the peer that reads it.
+func TestBloomFilterSize(test *testing.T) {
+
+	if size := len(newBloomFilter(1024).encode()); size != bloomFilterSize(1024) {
+		test.Fatal("Wrong size!", size)
+	}
+
+	config := DefaultConfig()
+	config.ReconcileMaxBufferSize = uint32(bloomFilterSize(config.ReconcileWindow))
+	if err := config.validate(); err != nil {
+		test.Fatal(err)
+	}
+	config.ReconcileMaxBufferSize--
+	if config.validate() == nil {
+		test.Fatal("Accepted a summary that peers cannot read!")
+	}
+
+}
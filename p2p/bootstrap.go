@@ -98,15 +98,22 @@ func (client *client) bootstrap() (func(), error) {
 
 	// Register services.
 	client.registerAuthService()
+	client.registerControlService()
+	client.registerDeliverService()
 	client.registerPairService()
 	client.registerPingService()
+	client.registerReconcileService()
 	client.registerSampleService()
 
+	// Rejoin the network through known peers while greeting the seed nodes.
+	shutdownRestore := client.restorePeers()
+
 	// Greet the seed nodes.
 	var group sync.WaitGroup
 	for _, node := range client.config.SeedNodes {
 		address, err := multiaddr.NewMultiaddr(node)
 		if err != nil {
+			shutdownRestore()
 			return nil, errors.New("Cannot parse address of seed node")
 		}
 		group.Add(1)
@@ -120,6 +127,12 @@ func (client *client) bootstrap() (func(), error) {
 	}
 	group.Wait()
 
+	// Save known peers.
+	shutdownPersistence := func() {}
+	if client.config.DataDir != "" {
+		shutdownPersistence = client.persistPeers()
+	}
+
 	// Discover peers.
 	shutdownPeerDiscovery := func() {}
 	if !client.config.DisablePeerDiscovery {
@@ -138,6 +151,12 @@ func (client *client) bootstrap() (func(), error) {
 		shutdownBroadcast = client.activateBroadcast()
 	}
 
+	// Reconcile artifacts.
+	shutdownReconciliation := func() {}
+	if !client.config.DisableReconciliation {
+		shutdownReconciliation = client.activateReconciliation()
+	}
+
 	// Share analytics with core developers.
 	shutdownAnalytics := func() {}
 	if !client.config.DisableAnalytics {
@@ -150,6 +169,9 @@ func (client *client) bootstrap() (func(), error) {
 		shutdownBroadcast()
 		shutdownNATMonitor()
 		shutdownPeerDiscovery()
+		shutdownPersistence()
+		shutdownReconciliation()
+		shutdownRestore()
 		shutdownStreamDiscovery()
 		client.host.Close()
 	}
@@ -217,7 +239,7 @@ func (client *client) hello(seedAddress multiaddr.Multiaddr) error {
 	)
 
 	// Update the routing table.
-	client.table.Update(seedId)
+	client.update(seedId)
 
 	// Success.
 	return nil
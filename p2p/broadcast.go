@@ -9,15 +9,24 @@
 package p2p
 
 import (
+	"encoding/hex"
 	"io"
+	"io/ioutil"
 	"sort"
+	"sync"
+	"time"
 
 	"gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
 
 	"github.com/dfinity/go-revolver/artifact"
+	"github.com/dfinity/go-revolver/streamstore"
 	"github.com/dfinity/go-revolver/util"
 )
 
+// The time to wait before retrying a peer whose queue was full. It doubles with
+// every retry.
+const queueFullBackoff = 100 * time.Millisecond
+
 // Activate the artifact broadcast.
 func (client *client) activateBroadcast() func() {
 
@@ -33,9 +42,10 @@ func (client *client) activateBroadcast() func() {
 			select {
 			case <-notify:
 				return
-			case object := <-client.send:
-				client.artifactCache.Add(object.Checksum(), object.Size())
-				client.broadcast(object)
+			case request := <-client.send:
+				object := request.artifact
+				client.artifactCache.Add(object.Checksum(), routeOf(object))
+				client.broadcast(object, request.receipt)
 			}
 		}
 	}()
@@ -45,15 +55,23 @@ func (client *client) activateBroadcast() func() {
 
 }
 
-// Broadcast an artifact.
-func (client *client) broadcast(object artifact.Artifact) {
-
-	// Get the artifact metadata.
-	metadata := artifact.EncodeMetadata(object)
+// Broadcast an artifact and record its delivery in a receipt.
+func (client *client) broadcast(object artifact.Artifact, receipt *Receipt) {
 
-	// Calculate the number of chunks to transfer.
-	chunks := int((object.Size()+client.config.ArtifactChunkSize-1)/
-		client.config.ArtifactChunkSize + 1)
+	// Encode the artifact header if the artifact may travel any further.
+	header, ok := client.header(object)
+	if !ok {
+		checksum := object.Checksum()
+		client.logger.Debugf("Cannot relay artifact with checksum %s: hop limit reached", hex.EncodeToString(checksum[:4]))
+		_, err := io.CopyN(ioutil.Discard, object, int64(object.Size()))
+		if err != nil {
+			object.Disconnect()
+		} else {
+			object.Close()
+		}
+		receipt.finish()
+		return
+	}
 
 	// Create a sorted exclude list from the witness cache.
 	var exclude peer.IDSlice
@@ -65,22 +83,118 @@ func (client *client) broadcast(object artifact.Artifact) {
 	}
 	sort.Sort(exclude)
 
-	// Send the artifact metadata to those who have not seen it.
-	errors := make([]map[peer.ID]chan error, chunks)
-	errors[0] = client.streamstore.Apply(
-		func(peerId peer.ID, writer io.Writer) error {
-			return util.WriteWithTimeout(
-				writer,
-				metadata[:],
-				client.config.Timeout,
-			)
-		},
-		exclude,
-	)
+	// Create a shipment to share the chunks between transfers.
+	s := client.newShipment(client.lane(object.Size()), header, client.chunks(object.Size()))
+
+	// Send the artifact to those who have not seen it.
+	results := s.lane.apply(client.writeShipment(s), exclude)
+
+	// Reroute around anyone who fails to receive it.
+	go func() {
+		client.collect(s, results, exclude, true, receipt)
+		receipt.finish()
+	}()
+
+	// Read the artifact into the buffer.
+	err := client.fill(object, s.buffer)
+	if err != nil {
+		client.logger.Warning("Cannot read artifact", err)
+		object.Disconnect()
+		return
+	}
+
+	// Close the artifact.
+	object.Close()
+
+}
+
+// Encode the metadata and route of an artifact for the next hop. This fails if
+// the artifact has exhausted its hop limit.
+func (client *client) header(object artifact.Artifact) ([]byte, bool) {
+	route, ok := client.route(object)
+	if !ok {
+		return nil, false
+	}
+	metadata := artifact.EncodeMetadata(object)
+	header := append([]byte{stx}, metadata[:]...)
+	return append(header, route...), true
+}
+
+// Compute the route of an artifact to the next hop. This fails if the artifact
+// has exhausted its hop limit. An artifact that has not travelled yet gets the
+// maximum hop limit unless its sender chose a lower one.
+func (client *client) route(object artifact.Artifact) ([]byte, bool) {
+
+	hops := object.Hops()
+	hopLimit := object.HopLimit()
+	if hops == 0 && (hopLimit == 0 || int(hopLimit) > client.config.ArtifactMaxHops) {
+		hopLimit = uint8(client.config.ArtifactMaxHops)
+	}
+	if hopLimit == 0 || hops == 255 {
+		return nil, false
+	}
+
+	// Append the client to the path of the artifact.
+	path := object.Path()
+	if client.config.ArtifactPathLength > 0 {
+		path = append(path, artifact.NewRelay(client.id.Pretty()))
+		if len(path) > client.config.ArtifactPathLength {
+			path = path[len(path)-client.config.ArtifactPathLength:]
+		}
+	}
+
+	return artifact.EncodeRoute(hops+1, hopLimit-1, path), true
+
+}
+
+// This type records the route by which an artifact reached the client, so that
+// the artifact keeps its reach when it is sent again.
+type artifactRoute struct {
+	hops     uint8
+	hopLimit uint8
+	path     []artifact.Relay
+}
+
+// Get the route of an artifact.
+func routeOf(object artifact.Artifact) artifactRoute {
+	return artifactRoute{object.Hops(), object.HopLimit(), object.Path()}
+}
+
+// This type gives an artifact the route by which it reached the client.
+type routed struct {
+	artifact.Artifact
+	route artifactRoute
+}
+
+// Get the number of hops that an artifact may still travel.
+func (object *routed) HopLimit() uint8 {
+	return object.route.hopLimit
+}
+
+// Get the number of hops that an artifact has travelled.
+func (object *routed) Hops() uint8 {
+	return object.route.hops
+}
+
+// Get the most recent relays of an artifact, ordered from oldest to newest.
+func (object *routed) Path() []artifact.Relay {
+	path := make([]artifact.Relay, len(object.route.path))
+	copy(path, object.route.path)
+	return path
+}
+
+// Calculate the number of chunks needed to transfer an artifact.
+func (client *client) chunks(size uint32) int {
+	return int((size + client.config.ArtifactChunkSize - 1) /
+		client.config.ArtifactChunkSize)
+}
+
+// Read an artifact in chunks, making each chunk available to the transfers
+// as soon as it is read.
+func (client *client) fill(object artifact.Artifact, buffer *chunkBuffer) error {
 
-	// Send the artifact in chunks.
 	leftover := object.Size()
-	for i := 1; i < chunks; i++ {
+	for i := range buffer.chunks {
 
 		// Create a chunk.
 		var data []byte
@@ -93,47 +207,237 @@ func (client *client) broadcast(object artifact.Artifact) {
 		}
 		_, err := io.ReadFull(object, data)
 		if err != nil {
-			client.logger.Warning("Cannot read artifact")
-			object.Disconnect()
-			return
+			buffer.abort(i, err)
+			return err
 		}
 
-		// Send the chunk to those who received the previous chunk.
-		previous := errors[i-1]
-		errors[i] = client.streamstore.Apply(
-			func(peerId peer.ID, writer io.Writer) error {
-				result, exists := previous[peerId]
-				if exists {
-					err := <-result
-					if err != nil {
-						return err
-					}
-					return util.WriteWithTimeout(
-						writer,
-						data,
-						client.config.Timeout,
-					)
-				}
-				return nil
-			},
-			exclude,
+		// Make the chunk available to the transfers.
+		buffer.put(i, data)
+
+	}
+
+	// Success.
+	return nil
+
+}
+
+// Transfer an artifact to a peer.
+func (client *client) transfer(writer io.Writer, header []byte, buffer *chunkBuffer) error {
+
+	// Send the artifact metadata and route.
+	err := util.WriteWithTimeout(
+		writer,
+		header,
+		client.config.Timeout,
+	)
+	if err != nil {
+		return err
+	}
+
+	// Send the artifact in chunks as they become available.
+	for i := range buffer.chunks {
+		data, err := buffer.get(i)
+		if err != nil {
+			return err
+		}
+		err = util.WriteWithTimeout(
+			writer,
+			data,
+			client.config.Timeout,
 		)
+		if err != nil {
+			return err
+		}
+	}
 
+	// Success.
+	return nil
+
+}
+
+// A shipment sends an artifact to paired peers over a lane, one transaction
+// per peer, so that nothing else is written to a stream between the header
+// and the chunks of the artifact.
+type shipment struct {
+	lane    lane
+	header  []byte
+	buffer  *chunkBuffer
+	lock    *sync.Mutex
+	started map[peer.ID]bool
+}
+
+// Create a shipment for an artifact with the given header and number of
+// chunks.
+func (client *client) newShipment(lane lane, header []byte, chunks int) *shipment {
+	return &shipment{
+		lane:    lane,
+		header:  header,
+		buffer:  newChunkBuffer(chunks),
+		lock:    &sync.Mutex{},
+		started: make(map[peer.ID]bool),
 	}
+}
 
-	// Remove anyone who failed to receive the artifact.
-	for peerId, result := range errors[chunks-1] {
-		go func(peerId peer.ID, result chan error) {
-			pid := peerId
-			err := <-result
-			if err != nil {
+// Check if the transfer of a shipment to a peer has started.
+func (s *shipment) begun(pid peer.ID) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.started[pid]
+}
+
+// Create a transaction that sends a shipment to a peer.
+func (client *client) writeShipment(s *shipment) func(peer.ID, io.Writer) error {
+	return func(pid peer.ID, writer io.Writer) error {
+		s.lock.Lock()
+		s.started[pid] = true
+		s.lock.Unlock()
+		return client.transfer(writer, s.header, s.buffer)
+	}
+}
+
+// Wait for the transfers of a shipment, and report the outcome for each peer
+// as soon as it is known.
+func (client *client) ship(results map[peer.ID]chan error, report func(peer.ID, error)) {
+	var group sync.WaitGroup
+	for pid, result := range results {
+		group.Add(1)
+		go func(pid peer.ID, result chan error) {
+			defer group.Done()
+			report(pid, <-result)
+		}(pid, result)
+	}
+	group.Wait()
+}
+
+// Wait for the shipment of an artifact to complete and record it in a receipt.
+// Peers whose queue was full received nothing, so they are retried once their
+// queue has had time to drain. If replace is set, anyone else who fails is
+// replaced by a fresh recommendation from the routing table. Both stop when
+// the broadcast deadline passes.
+func (client *client) collect(s *shipment, results map[peer.ID]chan error, exclude peer.IDSlice, replace bool, receipt *Receipt) {
+
+	deadline := time.Now().Add(client.config.BroadcastDeadline)
+	backoff := queueFullBackoff
+
+	// Never try the same peer twice, except to retry a full queue.
+	tried := make(peer.IDSlice, len(exclude))
+	copy(tried, exclude)
+
+	for {
+
+		// Wait for the transfers to complete.
+		lock := &sync.Mutex{}
+		var retry peer.IDSlice
+		failures := 0
+		client.ship(results, func(pid peer.ID, err error) {
+			lock.Lock()
+			defer lock.Unlock()
+			tried = append(tried, pid)
+			switch {
+			case err == nil:
+				receipt.deliver(pid)
+			case err == streamstore.ErrQueueFull && !s.begun(pid):
+				retry = append(retry, pid)
+			default:
 				client.logger.Debug(pid, "failed to receive the artifact", err)
 				client.streamstore.Remove(pid)
+				receipt.fail(pid, err)
+				failures++
 			}
-		}(peerId, result)
+		})
+		if !replace {
+			failures = 0
+		}
+
+		// Check if another attempt is possible.
+		if failures == 0 && len(retry) == 0 {
+			break
+		}
+		if s.buffer.err != nil || time.Now().Add(backoff).After(deadline) {
+			for _, pid := range retry {
+				receipt.fail(pid, streamstore.ErrQueueFull)
+			}
+			break
+		}
+
+		// Give full queues time to drain.
+		if len(retry) > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		// Retry peers whose queue was full and send the artifact to
+		// replacement peers.
+		results = make(map[peer.ID]chan error)
+		for pid, result := range s.lane.applyTo(client.writeShipment(s), retry) {
+			results[pid] = result
+		}
+		if failures > 0 {
+			sort.Sort(tried)
+			for pid, result := range s.lane.applyN(client.writeShipment(s), failures, tried) {
+				results[pid] = result
+			}
+		}
+		if len(results) == 0 {
+			for _, pid := range retry {
+				receipt.fail(pid, streamstore.ErrQueueFull)
+			}
+			break
+		}
+		client.logger.Debugf("Rerouting artifact to %d peers", len(results))
+
 	}
 
-	// Close the artifact.
-	object.Close()
+}
 
+// A buffer that shares the chunks of an artifact as they are read.
+type chunkBuffer struct {
+	chunks [][]byte
+	done   chan struct{}
+	err    error
+	ready  []chan struct{}
+}
+
+// Create a buffer for a given number of chunks.
+func newChunkBuffer(n int) *chunkBuffer {
+	buffer := &chunkBuffer{
+		chunks: make([][]byte, n),
+		done:   make(chan struct{}),
+		ready:  make([]chan struct{}, n),
+	}
+	for i := range buffer.ready {
+		buffer.ready[i] = make(chan struct{})
+	}
+	if n == 0 {
+		close(buffer.done)
+	}
+	return buffer
+}
+
+// Make a chunk available.
+func (buffer *chunkBuffer) put(i int, data []byte) {
+	buffer.chunks[i] = data
+	close(buffer.ready[i])
+	if i == len(buffer.chunks)-1 {
+		close(buffer.done)
+	}
+}
+
+// Abandon the remaining chunks starting from the given index.
+func (buffer *chunkBuffer) abort(i int, err error) {
+	buffer.err = err
+	for j := i; j < len(buffer.chunks); j++ {
+		close(buffer.ready[j])
+	}
+	close(buffer.done)
+}
+
+// Wait for a chunk to become available.
+func (buffer *chunkBuffer) get(i int) ([]byte, error) {
+	<-buffer.ready[i]
+	if buffer.chunks[i] == nil {
+		<-buffer.done
+		return nil, buffer.err
+	}
+	return buffer.chunks[i], nil
 }
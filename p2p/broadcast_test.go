@@ -10,13 +10,21 @@ package p2p
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"io"
 	"math/rand"
+	"sort"
+	"sync"
 	"testing"
 	"time"
 
 	"gx/ipfs/QmPgDWmTmuzvP7QE5zwo1TmjbJme9pmZHNujB2453jkCTr/go-libp2p-peerstore"
+	"gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
 
 	"github.com/dfinity/go-revolver/artifact"
+	"github.com/dfinity/go-revolver/streamstore"
+	"github.com/enzoh/go-logging"
 )
 
 // Show that a client can broadcast artifacts to its peers.
@@ -64,7 +72,7 @@ func TestBroadcast(test *testing.T) {
 		}
 
 		// Send the artifact to the second client.
-		client1.send <- artifactOut
+		client1.Send(artifactOut)
 
 		select {
 
@@ -90,3 +98,347 @@ func TestBroadcast(test *testing.T) {
 	}
 
 }
+
+// Show that a client can obtain a receipt for the delivery of an artifact.
+func TestSendWithReceipt(test *testing.T) {
+
+	// Create a client.
+	client1, shutdown1 := newTestClient(test)
+	defer shutdown1()
+
+	// Create a second client.
+	client2, shutdown2 := newTestClient(test)
+	defer shutdown2()
+
+	// Add the second client to the peer store of the first.
+	client1.peerstore.AddAddrs(
+		client2.id,
+		client2.host.Addrs(),
+		peerstore.ProviderAddrTTL,
+	)
+
+	// Pair the first and second client.
+	success, err := client1.pair(client2.id)
+	if err != nil || !success {
+		test.Fatal(err)
+	}
+
+	// Create an artifact.
+	artifactOut, err := artifact.FromBytes([]byte("This is a test."), false)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	// Send the artifact to the second client.
+	receipt, err := client1.SendWithReceipt(artifactOut)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	// Consume the artifact on the second client.
+	go func() {
+		artifact.ToBytes(<-client2.receive)
+	}()
+
+	// Wait for the transfer to finish.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = receipt.Wait(ctx)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	// Verify that the second client received the artifact.
+	delivered := receipt.Delivered()
+	if len(delivered) != 1 || delivered[0] != client2.ID() {
+		test.Fatal("Unexpected receipt!", delivered, receipt.Failed())
+	}
+	if receipt.Finished().IsZero() {
+		test.Fatal("Missing finish time!")
+	}
+
+}
+
+// Show that transfers sharing a chunk buffer observe a failed read.
+func TestChunkBuffer(test *testing.T) {
+
+	buffer := newChunkBuffer(3)
+
+	// Read the first chunk and fail to read the rest.
+	go func() {
+		buffer.put(0, []byte("chunk"))
+		buffer.abort(1, errors.New("Cannot read artifact"))
+	}()
+
+	// Verify that the first chunk is available.
+	data, err := buffer.get(0)
+	if err != nil || string(data) != "chunk" {
+		test.Fatal("Unexpected chunk!", data, err)
+	}
+
+	// Verify that the remaining chunks report the failure.
+	for i := 1; i < 3; i++ {
+		_, err = buffer.get(i)
+		if err == nil {
+			test.Fatal("Missing error!")
+		}
+	}
+
+}
+
+// Show that an artifact stops travelling once it exhausts its hop limit.
+func TestRoute(test *testing.T) {
+
+	client := &client{config: DefaultConfig(), id: "QmTest"}
+	client.config.ArtifactPathLength = 2
+
+	// Create an artifact that may travel one hop.
+	object, err := artifact.FromBytes([]byte("This is a test."), false)
+	if err != nil {
+		test.Fatal(err)
+	}
+	object = artifact.WithHopLimit(object, 1)
+
+	// Send the artifact to the next hop.
+	route, ok := client.route(object)
+	if !ok {
+		test.Fatal("Cannot route artifact!")
+	}
+	hops, hopLimit, path, err := artifact.DecodeRoute(bytes.NewReader(route))
+	if err != nil {
+		test.Fatal(err)
+	}
+	if hops != 1 || hopLimit != 0 || len(path) != 1 || path[0] != artifact.NewRelay(client.ID()) {
+		test.Fatal("Unexpected route!", hops, hopLimit, path)
+	}
+
+	// Verify that the next hop cannot relay the artifact.
+	relayed := artifact.NewWithRoute(nil, object.Checksum(), false, 0, time.Now(), hops, hopLimit, path)
+	_, ok = client.route(relayed)
+	if ok {
+		test.Fatal("Relayed artifact beyond its hop limit!")
+	}
+
+}
+
+// A lane that runs the transactions of each peer in order on an in-memory
+// stream. It rejects a number of transactions for each peer as if its queue
+// were full.
+type testLane struct {
+	lock    *sync.Mutex
+	peers   peer.IDSlice
+	streams map[peer.ID]*bytes.Buffer
+	queues  map[peer.ID]chan func()
+	full    map[peer.ID]int
+}
+
+func newTestLane(peers peer.IDSlice) *testLane {
+	l := &testLane{
+		lock:    &sync.Mutex{},
+		peers:   peers,
+		streams: make(map[peer.ID]*bytes.Buffer),
+		queues:  make(map[peer.ID]chan func()),
+		full:    make(map[peer.ID]int),
+	}
+	for _, pid := range peers {
+		l.streams[pid] = &bytes.Buffer{}
+		l.queues[pid] = make(chan func(), 16)
+		go func(queue chan func()) {
+			for tx := range queue {
+				tx()
+			}
+		}(l.queues[pid])
+	}
+	return l
+}
+
+func (l *testLane) close() {
+	for _, queue := range l.queues {
+		close(queue)
+	}
+}
+
+func (l *testLane) applyTo(f func(peer.ID, io.Writer) error, peers peer.IDSlice) map[peer.ID]chan error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	results := make(map[peer.ID]chan error)
+	for _, pid := range peers {
+		result := make(chan error, 1)
+		results[pid] = result
+		if l.full[pid] > 0 {
+			l.full[pid]--
+			result <- streamstore.ErrQueueFull
+			continue
+		}
+		stream := l.streams[pid]
+		l.queues[pid] <- func() {
+			result <- f(pid, stream)
+		}
+	}
+	return results
+}
+
+func (l *testLane) lane() lane {
+	applyN := func(f func(peer.ID, io.Writer) error, count int, exclude peer.IDSlice) map[peer.ID]chan error {
+		var peers peer.IDSlice
+		for _, pid := range l.peers {
+			i := sort.Search(len(exclude), func(i int) bool {
+				return exclude[i] >= pid
+			})
+			if len(peers) < count && (i == len(exclude) || exclude[i] != pid) {
+				peers = append(peers, pid)
+			}
+		}
+		return l.applyTo(f, peers)
+	}
+	apply := func(f func(peer.ID, io.Writer) error, exclude peer.IDSlice) map[peer.ID]chan error {
+		return applyN(f, len(l.peers), exclude)
+	}
+	return lane{apply, applyN, l.applyTo}
+}
+
+// Decode the artifacts written to a stream, as the receiving peer would.
+func decodeArtifacts(stream *bytes.Buffer) (map[[32]byte][]byte, error) {
+	artifacts := make(map[[32]byte][]byte)
+	for stream.Len() > 0 {
+		frame, err := stream.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if frame != stx {
+			return nil, errors.New("Unexpected frame")
+		}
+		var metadata [45]byte
+		_, err = io.ReadFull(stream, metadata[:])
+		if err != nil {
+			return nil, err
+		}
+		checksum, _, size, _ := artifact.DecodeMetadata(metadata)
+		_, _, _, err = artifact.DecodeRoute(stream)
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, size)
+		_, err = io.ReadFull(stream, data)
+		if err != nil {
+			return nil, err
+		}
+		artifacts[checksum] = data
+	}
+	return artifacts, nil
+}
+
+// Show that artifacts shipped at once over the same lane reach each peer
+// whole, and that a peer whose queue was full is retried.
+func TestShipment(test *testing.T) {
+
+	client := &client{
+		config: DefaultConfig(),
+		id:     "QmTest",
+		logger: logging.MustGetLogger("p2p"),
+	}
+	client.config.ArtifactChunkSize = 4
+
+	peers := peer.IDSlice{"a", "b"}
+	l := newTestLane(peers)
+	defer l.close()
+	l.full["b"] = 1
+
+	// Ship two artifacts of several chunks at once.
+	sent := make(map[[32]byte][]byte)
+	var receipts []*Receipt
+	var group sync.WaitGroup
+	for _, data := range [][]byte{[]byte("0123456789"), []byte("abcdefghijklmnopqrstuvwxyz")} {
+		object, err := artifact.FromBytes(data, false)
+		if err != nil {
+			test.Fatal(err)
+		}
+		sent[object.Checksum()] = data
+		header, ok := client.header(object)
+		if !ok {
+			test.Fatal("Cannot route artifact!")
+		}
+		s := client.newShipment(l.lane(), header, client.chunks(object.Size()))
+		results := s.lane.apply(client.writeShipment(s), nil)
+		receipt := newReceipt(object.Checksum())
+		receipts = append(receipts, receipt)
+		go func() {
+			client.collect(s, results, nil, true, receipt)
+			receipt.finish()
+		}()
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			err := client.fill(object, s.buffer)
+			if err != nil {
+				test.Error(err)
+			}
+		}()
+	}
+	group.Wait()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, receipt := range receipts {
+		err := receipt.Wait(ctx)
+		if err != nil {
+			test.Fatal(err)
+		}
+		if len(receipt.Delivered()) != 2 || len(receipt.Failed()) != 0 {
+			test.Fatal("Unexpected receipt!", receipt.Delivered(), receipt.Failed())
+		}
+	}
+
+	// Verify that each stream decodes into both artifacts.
+	for _, pid := range peers {
+		received, err := decodeArtifacts(l.streams[pid])
+		if err != nil {
+			test.Fatal("Corrupt stream!", pid, err)
+		}
+		if len(received) != len(sent) {
+			test.Fatal("Missing artifacts!", pid, len(received))
+		}
+		for checksum, data := range sent {
+			if !bytes.Equal(received[checksum], data) {
+				test.Fatal("Corrupt artifact!", pid, string(received[checksum]))
+			}
+		}
+	}
+
+}
+
+// Show that an artifact sent again keeps the route by which it was received.
+func TestRouted(test *testing.T) {
+
+	client := &client{config: DefaultConfig(), id: "QmTest"}
+	client.config.ArtifactPathLength = 4
+
+	// Receive an artifact that may travel one more hop.
+	relays := []artifact.Relay{artifact.NewRelay("QmRelay")}
+	received := artifact.NewWithRoute(nil, [32]byte{}, false, 0, time.Now(), 2, 1, relays)
+	route := routeOf(received)
+
+	// Send a copy of the artifact, as provided by the application.
+	object, err := artifact.FromBytes([]byte("This is a test."), false)
+	if err != nil {
+		test.Fatal(err)
+	}
+	encoded, ok := client.route(&routed{object, route})
+	if !ok {
+		test.Fatal("Cannot route artifact!")
+	}
+	hops, hopLimit, path, err := artifact.DecodeRoute(bytes.NewReader(encoded))
+	if err != nil {
+		test.Fatal(err)
+	}
+	if hops != 3 || hopLimit != 0 || len(path) != 2 || path[0] != relays[0] {
+		test.Fatal("Unexpected route!", hops, hopLimit, path)
+	}
+
+	// Verify that an artifact without hops left is not sent again.
+	route.hopLimit = 0
+	_, ok = client.route(&routed{object, route})
+	if ok {
+		test.Fatal("Sent artifact beyond its hop limit!")
+	}
+
+}
@@ -16,6 +16,7 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"gx/ipfs/QmPgDWmTmuzvP7QE5zwo1TmjbJme9pmZHNujB2453jkCTr/go-libp2p-peerstore"
 	"gx/ipfs/QmSAFA8v42u4gpJNy1tb7vW3JiiXiaYDC2b845c2RnNSJL/go-libp2p-kbucket"
@@ -26,7 +27,9 @@ import (
 	"gx/ipfs/QmefgzMbKZYsmHFkLqxgaTBG9ypeEjrdWRD5WXH4j1cWDL/go-libp2p/p2p/host/basic"
 
 	"github.com/dfinity/go-revolver/artifact"
+	"github.com/dfinity/go-revolver/routingtable"
 	"github.com/dfinity/go-revolver/streamstore"
+	"github.com/dfinity/go-revolver/vivaldi"
 	"github.com/enzoh/go-logging"
 	"github.com/hashicorp/golang-lru"
 )
@@ -45,9 +48,21 @@ type Client interface {
 	// Get the stream count.
 	StreamCount() int
 
+	// Change the inbound and outbound stream capacity.
+	SetStreamCapacity(inbound, outbound int) error
+
+	// Get the latency rings that gossip is routed through.
+	Rings() []routingtable.RingInfo
+
 	// Send an artifact.
 	Send(artifact artifact.Artifact)
 
+	// Send an artifact and get a receipt for its delivery.
+	SendWithReceipt(artifact artifact.Artifact) (*Receipt, error)
+
+	// Send an artifact to specific peers.
+	SendTo(peers []string, artifact artifact.Artifact) (*Receipt, error)
+
 	// Receive an artifact.
 	Receive() artifact.Artifact
 
@@ -74,23 +89,27 @@ type client struct {
 	artifactCache            *lru.Cache
 	artifactCacheLock        *sync.Mutex
 	artifactRequests         chan artifactRequest
+	asnTable                 *asnTable
 	challengeRequests        chan challengeRequest
 	commitmentRequests       chan commitmentRequest
 	config                   *Config
+	coordinates              *vivaldi.System
 	context                  context.Context
 	host                     *basichost.BasicHost
 	id                       peer.ID
 	key                      keyspace.Key
+	lastSeen                 map[peer.ID]time.Time
+	lastSeenLock             *sync.Mutex
 	logger                   *logging.Logger
 	peerstore                peerstore.Peerstore
 	proofRequests            chan proofRequest
 	protocol                 protocol.ID
 	receive                  chan artifact.Artifact
-	send                     chan artifact.Artifact
+	send                     chan sendRequest
 	spammerCache             *lru.Cache
 	spammerCacheLock         *sync.Mutex
 	streamstore              streamstore.Streamstore
-	table                    *kbucket.RoutingTable
+	table                    routingtable.RoutingTable
 	unsetArtifactHandler     func()
 	unsetChallengeHandler    func()
 	unsetCommitmentHandler   func()
@@ -112,6 +131,11 @@ type artifactRequest struct {
 	response chan artifact.Artifact
 }
 
+type sendRequest struct {
+	artifact artifact.Artifact
+	receipt  *Receipt
+}
+
 // Addresses -- List the addresses.
 func (client *client) Addresses() []string {
 	addrs := client.host.Addrs()
@@ -134,12 +158,43 @@ func (client *client) PeerCount() int {
 
 // StreamCount -- Get the stream count.
 func (client *client) StreamCount() int {
-	return client.streamstore.InboundSize() + client.streamstore.OutboundSize()
+	inbound, outbound := client.streamstore.ReservedSize()
+	return client.streamstore.InboundSize() + client.streamstore.OutboundSize() + inbound + outbound
+}
+
+// Rings -- Get the latency rings that gossip is routed through, or nil if the
+// routing table does not place peers in latency rings.
+func (client *client) Rings() []routingtable.RingInfo {
+	return client.streamstore.Rings()
+}
+
+// SetStreamCapacity -- Change the inbound and outbound stream capacity. If the
+// capacity shrinks, the lowest-value streams are closed. If it grows, new
+// streams are discovered right away.
+func (client *client) SetStreamCapacity(inbound, outbound int) error {
+	err := client.streamstore.SetCapacity(inbound, outbound)
+	if err != nil {
+		return err
+	}
+	if !client.config.DisableStreamDiscovery {
+		go client.replenishStreamstore()
+	}
+	return nil
 }
 
 // Send -- Send an artifact.
 func (client *client) Send(artifact artifact.Artifact) {
-	client.send <- artifact
+	client.send <- sendRequest{artifact, newReceipt(artifact.Checksum())}
+}
+
+// SendWithReceipt -- Send an artifact and get a receipt for its delivery.
+func (client *client) SendWithReceipt(artifact artifact.Artifact) (*Receipt, error) {
+	if client.config.DisableBroadcast {
+		return nil, errors.New("Cannot send artifact: broadcast is disabled")
+	}
+	receipt := newReceipt(artifact.Checksum())
+	client.send <- sendRequest{artifact, receipt}
+	return receipt, nil
 }
 
 // Receive -- Receive an artifact.
@@ -177,6 +232,28 @@ func (client *client) SetArtifactHandler(handler ArtifactHandler) {
 
 }
 
+// Request an artifact from the artifact request handler. This returns nil if
+// the handler cannot provide the artifact before the deadline.
+func (client *client) requestArtifact(checksum [32]byte, deadline time.Time) artifact.Artifact {
+
+	timeout := time.After(time.Until(deadline))
+
+	response := make(chan artifact.Artifact, 1)
+	select {
+	case client.artifactRequests <- artifactRequest{checksum, response}:
+	case <-timeout:
+		return nil
+	}
+
+	select {
+	case object := <-response:
+		return object
+	case <-timeout:
+		return nil
+	}
+
+}
+
 // New -- Create a client.
 func (config *Config) New() (Client, func(), error) {
 	return config.create()
@@ -205,6 +282,14 @@ func (config *Config) create() (*client, func(), error) {
 	// Create an artifact request queue.
 	client.artifactRequests = make(chan artifactRequest, client.config.ArtifactQueueSize)
 
+	// Load the autonomous system numbers.
+	if client.config.DiversityASNFile != "" {
+		client.asnTable, err = loadASNTable(client.config.DiversityASNFile)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
 	// Create a challenge request queue.
 	client.challengeRequests = make(chan challengeRequest, 1)
 
@@ -242,6 +327,13 @@ func (config *Config) create() (*client, func(), error) {
 	// Create a key in the Kademlia key space.
 	client.key = keyspace.XORKeySpace.Key(kbucket.ConvertPeerID(client.id))
 
+	// Create a network coordinate system.
+	client.coordinates = vivaldi.New(vivaldi.NewDefaultConfig())
+
+	// Create a record of when peers were last seen.
+	client.lastSeen = make(map[peer.ID]time.Time)
+	client.lastSeenLock = &sync.Mutex{}
+
 	// Create a logger.
 	client.logger = logging.MustGetLogger("p2p")
 
@@ -263,7 +355,7 @@ func (config *Config) create() (*client, func(), error) {
 	)
 
 	// Create the artifact queues.
-	client.send = make(chan artifact.Artifact, client.config.ArtifactQueueSize)
+	client.send = make(chan sendRequest, client.config.ArtifactQueueSize)
 	client.receive = make(chan artifact.Artifact, client.config.ArtifactQueueSize)
 
 	// Create a spammer cache.
@@ -273,21 +365,86 @@ func (config *Config) create() (*client, func(), error) {
 	}
 	client.spammerCacheLock = &sync.Mutex{}
 
+	// Decode the trusted peers.
+	trusted := make([]peer.ID, len(client.config.TrustedPeers))
+	for i := range client.config.TrustedPeers {
+		trusted[i], err = peer.IDB58Decode(client.config.TrustedPeers[i])
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Create the routing table for gossip, if any. It only holds paired
+	// peers, so that every peer it recommends has a stream, and the stream
+	// store adds and removes them as they pair and unpair.
+	var gossip routingtable.RoutingTable
+	if client.config.RoutingTableFactory != nil {
+		gossip = client.config.RoutingTableFactory(client.id, client.probeStreamLatency)
+	}
+
 	// Create a stream store.
-	client.streamstore = streamstore.New(
-		client.config.StreamstoreInboundCapacity,
-		client.config.StreamstoreOutboundCapacity,
-		client.config.StreamstoreQueueSize,
-		client.probeLatency,
+	client.streamstore = streamstore.NewWithConfig(
+		streamstore.Config{
+			ID:                       client.id,
+			InboundCapacity:          client.config.StreamstoreInboundCapacity,
+			OutboundCapacity:         client.config.StreamstoreOutboundCapacity,
+			QueueSize:                client.config.StreamstoreQueueSize,
+			Trusted:                  trusted,
+			ReservedInboundCapacity:  client.config.StreamstoreReservedInbound,
+			ReservedOutboundCapacity: client.config.StreamstoreReservedOutbound,
+			LatencyProbeFn:           client.probeStreamLatency,
+			LatencyEstimateFn:        client.coordinates.Estimate,
+			Heartbeat:                []byte{syn},
+			HeartbeatInterval:        client.config.StreamHeartbeatInterval,
+			IdleTimeout:              client.config.StreamIdleTimeout,
+			IdleFn: func(peer.ID) {
+				if !client.config.DisableStreamDiscovery {
+					go client.replenishStreamstore()
+				}
+			},
+			EvictionGracePeriod: client.config.StreamEvictionGracePeriod,
+			EvictionInterval:    client.config.StreamEvictionInterval,
+			EvictionMargin:      client.config.StreamEvictionMargin,
+			RequestFrame:        enq,
+			ResponseFrame:       ack,
+			ErrorFrame:          nak,
+			MaxMessageSize:      client.config.StreamRequestMaxBufferSize,
+			RequestFn:           client.answer,
+			WriteTimeout:        client.config.Timeout,
+			RoutingTable:        gossip,
+			Rings: routingtable.RingsConfig{
+				RingsCount:            client.config.RingsCount,
+				BaseLatency:           client.config.RingsBaseLatency,
+				LatencyGrowthFactor:   client.config.RingsLatencyGrowthFactor,
+				SampleSize:            client.config.RingsSampleSize,
+				SamplePeriod:          client.config.RingsSamplePeriod,
+				Hysteresis:            client.config.RingsHysteresis,
+				ProbeQueueSize:        client.config.RingsProbeQueueSize,
+				ProbeWorkers:          client.config.RingsProbeWorkers,
+				ReputationDecay:       client.config.RingsReputationDecay,
+				ReputationHistorySize: client.config.RingsReputationHistorySize,
+				SilenceTimeout:        client.config.RingsSilenceTimeout,
+				MaxFailures:           client.config.RingsMaxFailures,
+				RingCapacity:          client.config.RingsCapacity,
+				ReplacementCacheSize:  client.config.RingsReplacementCacheSize,
+				Logger:                *logging.MustGetLogger("routingtable"),
+			},
+		},
 	)
 
-	// Create a routing table.
-	client.table = kbucket.NewRoutingTable(
-		client.config.KBucketSize,
-		client.key.Bytes,
-		client.config.LatencyTolerance,
-		client.peerstore,
-	)
+	// Create a routing table for discovery from the same factory, or else a
+	// Kademlia one. It holds every known peer, paired or not.
+	factory := client.config.RoutingTableFactory
+	if factory == nil {
+		factory = routingtable.NewKademliaFactory(
+			routingtable.KademliaConfig{
+				BucketSize:       client.config.KBucketSize,
+				LatencyTolerance: client.config.LatencyTolerance,
+				Metrics:          client.peerstore,
+			},
+		)
+	}
+	client.table = factory(client.id, client.probeLatency)
 
 	// Add the client to its routing table.
 	client.table.Update(client.id)
@@ -324,6 +481,11 @@ func (config *Config) create() (*client, func(), error) {
 		client.unsetProofHandler()
 		client.unsetVerificationHandler()
 		shutdown()
+		client.streamstore.Shutdown()
+		if gossip != nil {
+			gossip.Shutdown()
+		}
+		client.table.Shutdown()
 	}, nil
 
 }
@@ -10,6 +10,11 @@ package p2p
 
 import (
 	"testing"
+	"time"
+
+	"gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
+
+	"github.com/dfinity/go-revolver/routingtable"
 )
 
 // Create a test client.
@@ -33,3 +38,54 @@ func newTestClient(test *testing.T) (*client, func()) {
 	return client, shutdown
 
 }
+
+// Show that discovery and gossip each get a routing table from the factory,
+// so that gossip is only routed through paired peers.
+func TestSharedRoutingTable(test *testing.T) {
+
+	// Create a configuration with a routing table factory.
+	calls := 0
+	config := DefaultConfig()
+	config.DisableAnalytics = true
+	config.DisableNATPortMap = true
+	config.DisablePeerDiscovery = true
+	config.DisableStreamDiscovery = true
+	config.IP = "127.0.0.1"
+	config.RoutingTableFactory = func(self peer.ID, probe routingtable.LatencyProbeFn) routingtable.RoutingTable {
+		calls++
+		conf := routingtable.NewDefaultRingsConfig(probe)
+		conf.LatencyEstimateFn = func(peer.ID) (time.Duration, bool) {
+			return time.Millisecond, true
+		}
+		return routingtable.NewRingsRoutingTable(conf)
+	}
+
+	// Create a client.
+	client, shutdown, err := config.create()
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer shutdown()
+
+	// Verify that the factory was called for each role.
+	if calls != 2 {
+		test.Fatal("Wrong number of routing tables!", calls)
+	}
+
+	// Verify that the client is in its routing table.
+	if !client.table.Find(client.id) {
+		test.Fatal("Client is missing from its routing table!")
+	}
+
+	// Verify that gossip does not see the unpaired peers that discovery adds.
+	pid := peer.ID("unpaired")
+	client.table.Add(pid)
+	for _, ring := range client.streamstore.Rings() {
+		for _, member := range ring.Members {
+			if member.ID == pid {
+				test.Fatal("Gossip routes through an unpaired peer!")
+			}
+		}
+	}
+
+}
@@ -17,6 +17,9 @@ import (
 	"time"
 
 	"gx/ipfs/QmXY77cVe7rVRQXZZQRioukUM7aRW3BTcAgJe12MCtb3Ji/go-multiaddr"
+	"gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
+
+	"github.com/dfinity/go-revolver/routingtable"
 )
 
 // Config -- This type provides all available options to configure a client.
@@ -24,37 +27,81 @@ type Config struct {
 	AnalyticsInterval           time.Duration
 	AnalyticsURL                string
 	AnalyticsUserData           string
+	AnchorPeerRetries           int
+	AnchorPeers                 []string
 	ArtifactCacheSize           int
 	ArtifactChunkSize           uint32
 	ArtifactMaxBufferSize       uint32
+	ArtifactMaxHops             int
+	ArtifactPathLength          int
 	ArtifactQueueSize           int
+	BroadcastDeadline           time.Duration
 	ChallengeMaxBufferSize      uint32
 	ClusterID                   int
 	CommitmentMaxBufferSize     uint32
+	ControlMaxArtifactSize      uint32
+	DataDir                     string
 	DisableAnalytics            bool
 	DisableBroadcast            bool
+	DisableControlStream        bool
 	DisableNATPortMap           bool
 	DisablePeerDiscovery        bool
+	DisableReconciliation       bool
 	DisableStreamDiscovery      bool
+	DiversityASNFile            string
+	DiversityMaxPerASN          int
+	DiversityMaxPerIPv4Subnet16 int
+	DiversityMaxPerIPv4Subnet24 int
+	DiversityMaxPerIPv6Subnet48 int
 	IP                          string
 	KBucketSize                 int
 	LatencyTolerance            time.Duration
 	NATMonitorInterval          time.Duration
 	NATMonitorTimeout           time.Duration
 	Network                     string
+	PeerFileInterval            time.Duration
+	PeerFileSize                int
 	PingBufferSize              uint32
 	Port                        uint16
 	ProcessID                   int
 	ProofMaxBufferSize          uint32
 	RandomSeed                  string
+	ReconcileInterval           time.Duration
+	ReconcileMaxBufferSize      uint32
+	ReconcileWindow             int
+	RestoreTimeout              time.Duration
+	RingsBaseLatency            time.Duration
+	RingsCapacity               int
+	RingsCount                  int
+	RingsHysteresis             float64
+	RingsLatencyGrowthFactor    float64
+	RingsMaxFailures            int
+	RingsProbeQueueSize         int
+	RingsProbeWorkers           int
+	RingsReplacementCacheSize   int
+	RingsReputationDecay        float64
+	RingsReputationHistorySize  int
+	RingsSamplePeriod           time.Duration
+	RingsSampleSize             int
+	RingsSilenceTimeout         time.Duration
+	RoutingTableFactory         routingtable.Factory
 	SampleMaxBufferSize         uint32
 	SampleSize                  int
 	SeedNodes                   []string
 	SpammerCacheSize            int
+	StreamEvictionGracePeriod   time.Duration
+	StreamEvictionInterval      time.Duration
+	StreamEvictionMargin        float64
+	StreamHeartbeatInterval     time.Duration
+	StreamIdleTimeout           time.Duration
+	StreamRequestMaxBufferSize  uint32
 	StreamstoreInboundCapacity  int
 	StreamstoreOutboundCapacity int
 	StreamstoreQueueSize        int
+	StreamstoreReservedInbound  int
+	StreamstoreReservedOutbound int
 	Timeout                     time.Duration
+	TrustedPeers                []string
 	Version                     string
 	WitnessCacheSize            int
 }
@@ -65,38 +112,82 @@ func DefaultConfig() *Config {
 		AnalyticsInterval:       time.Minute,
 		AnalyticsURL:            "https://analytics.dfinity.build/report",
 		AnalyticsUserData:       "",
+		AnchorPeerRetries:       3,
+		AnchorPeers:             nil,
 		ArtifactCacheSize:       65536,
 		ArtifactChunkSize:       65536,
 		ArtifactMaxBufferSize:   8388608,
+		ArtifactMaxHops:         32,
+		ArtifactPathLength:      0,
 		ArtifactQueueSize:       8,
+		BroadcastDeadline:       30 * time.Second,
 		ChallengeMaxBufferSize:  32,
 		ClusterID:               0,
 		CommitmentMaxBufferSize: 32,
+		ControlMaxArtifactSize:  4096,
+		DataDir:                 "",
 		DisableAnalytics:        false,
 		DisableBroadcast:        false,
+		DisableControlStream:    false,
 		DisableNATPortMap:       false,
 		DisablePeerDiscovery:    false,
+		DisableReconciliation:   false,
 		DisableStreamDiscovery:  false,
+		DiversityASNFile:            "",
+		DiversityMaxPerASN:          0,
+		DiversityMaxPerIPv4Subnet16: 16,
+		DiversityMaxPerIPv4Subnet24: 4,
+		DiversityMaxPerIPv6Subnet48: 4,
 		IP:                          "0.0.0.0",
 		KBucketSize:                 16,
 		LatencyTolerance:            time.Minute,
 		NATMonitorInterval:          time.Second,
 		NATMonitorTimeout:           time.Minute,
 		Network:                     "revolver",
+		PeerFileInterval:            time.Minute,
+		PeerFileSize:                1024,
 		PingBufferSize:              32,
 		Port:                        0,
 		ProcessID:                   0,
 		ProofMaxBufferSize:          0,
 		RandomSeed:                  "",
+		ReconcileInterval:           10 * time.Second,
+		ReconcileMaxBufferSize:      8192,
+		ReconcileWindow:             1024,
+		RestoreTimeout:              time.Minute,
+		RingsBaseLatency:            8 * time.Millisecond,
+		RingsCapacity:               32,
+		RingsCount:                  8,
+		RingsHysteresis:             0.1,
+		RingsLatencyGrowthFactor:    2,
+		RingsMaxFailures:            3,
+		RingsProbeQueueSize:         1024,
+		RingsProbeWorkers:           4,
+		RingsReplacementCacheSize:   64,
+		RingsReputationDecay:        0.95,
+		RingsReputationHistorySize:  1024,
+		RingsSamplePeriod:           30 * time.Second,
+		RingsSampleSize:             16,
+		RingsSilenceTimeout:         5 * time.Minute,
+		RoutingTableFactory:         nil,
 		SampleMaxBufferSize:         8192,
 		SampleSize:                  16,
 		SeedNodes:                   nil,
 		SpammerCacheSize:            16384,
+		StreamEvictionGracePeriod:   time.Minute,
+		StreamEvictionInterval:      10 * time.Second,
+		StreamEvictionMargin:        0.05,
+		StreamHeartbeatInterval:     5 * time.Second,
+		StreamIdleTimeout:           30 * time.Second,
+		StreamRequestMaxBufferSize:  8192,
 		StreamstoreInboundCapacity:  48,
 		StreamstoreOutboundCapacity: 16,
 		StreamstoreQueueSize:        8192,
+		StreamstoreReservedInbound:  8,
+		StreamstoreReservedOutbound: 4,
 		Timeout:                     10 * time.Second,
-		Version:                     "0.1.0",
+		TrustedPeers:                nil,
+		Version:                     "0.2.0",
 		WitnessCacheSize:            65536,
 	}
 }
@@ -114,6 +205,22 @@ func (config *Config) validate() error {
 		return fmt.Errorf("Invalid analytics URL: %s", config.AnalyticsURL)
 	}
 
+	// The anchor peer retries must be a non-negative integer.
+	if config.AnchorPeerRetries < 0 {
+		return fmt.Errorf("Invalid anchor peer retries: %d", config.AnchorPeerRetries)
+	}
+
+	// The anchor peers must be parsable and identified.
+	for i := range config.AnchorPeers {
+		address, err := multiaddr.NewMultiaddr(config.AnchorPeers[i])
+		if err == nil {
+			_, _, err = parseIPFSAddress(address)
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid anchor peer: %s", config.AnchorPeers[i])
+		}
+	}
+
 	// The artifact cache size must be a positive integer.
 	if config.ArtifactCacheSize <= 0 {
 		return fmt.Errorf("Invalid artifact cache size: %d", config.ArtifactCacheSize)
@@ -129,11 +236,45 @@ func (config *Config) validate() error {
 		return errors.New("Invalid artifact max buffer size: 0")
 	}
 
+	// The artifact max hops must be a positive 8-bit integer.
+	if config.ArtifactMaxHops <= 0 || config.ArtifactMaxHops > 255 {
+		return fmt.Errorf("Invalid artifact max hops: %d", config.ArtifactMaxHops)
+	}
+
+	// The artifact path length must be a non-negative 8-bit integer.
+	if config.ArtifactPathLength < 0 || config.ArtifactPathLength > 255 {
+		return fmt.Errorf("Invalid artifact path length: %d", config.ArtifactPathLength)
+	}
+
 	// The artifact queue size must be a positive integer.
 	if config.ArtifactQueueSize <= 0 {
 		return fmt.Errorf("Invalid artifact queue size: %d", config.ArtifactQueueSize)
 	}
 
+	// The broadcast deadline must be a positive time duration.
+	if config.BroadcastDeadline <= 0 {
+		return fmt.Errorf("Invalid broadcast deadline: %d", config.BroadcastDeadline)
+	}
+
+	// The diversity limits must be non-negative integers.
+	if config.DiversityMaxPerASN < 0 {
+		return fmt.Errorf("Invalid maximum number of peers per ASN: %d", config.DiversityMaxPerASN)
+	}
+	if config.DiversityMaxPerIPv4Subnet16 < 0 {
+		return fmt.Errorf("Invalid maximum number of peers per IPv4 /16 subnet: %d", config.DiversityMaxPerIPv4Subnet16)
+	}
+	if config.DiversityMaxPerIPv4Subnet24 < 0 {
+		return fmt.Errorf("Invalid maximum number of peers per IPv4 /24 subnet: %d", config.DiversityMaxPerIPv4Subnet24)
+	}
+	if config.DiversityMaxPerIPv6Subnet48 < 0 {
+		return fmt.Errorf("Invalid maximum number of peers per IPv6 /48 subnet: %d", config.DiversityMaxPerIPv6Subnet48)
+	}
+
+	// The ASN limit requires a prefix file.
+	if config.DiversityMaxPerASN > 0 && config.DiversityASNFile == "" {
+		return errors.New("Missing ASN prefix file")
+	}
+
 	// The IP address must be parsable.
 	if net.ParseIP(config.IP) == nil {
 		return fmt.Errorf("Invalid IP address: %s", config.IP)
@@ -159,6 +300,16 @@ func (config *Config) validate() error {
 		return fmt.Errorf("Invalid NAT monitor timeout: %d", config.NATMonitorTimeout)
 	}
 
+	// The peer file interval must be a positive time duration.
+	if config.PeerFileInterval <= 0 {
+		return fmt.Errorf("Invalid peer file interval: %d", config.PeerFileInterval)
+	}
+
+	// The peer file size must be a positive integer.
+	if config.PeerFileSize <= 0 {
+		return fmt.Errorf("Invalid peer file size: %d", config.PeerFileSize)
+	}
+
 	// The ping buffer size must be a non-zero unsigned 32-bit integer.
 	if config.PingBufferSize == 0 {
 		return errors.New("Invalid ping buffer size: 0")
@@ -170,6 +321,102 @@ func (config *Config) validate() error {
 		return fmt.Errorf("Invalid random seed: %s", config.RandomSeed)
 	}
 
+	// The reconciliation interval must be a positive time duration.
+	if config.ReconcileInterval <= 0 {
+		return fmt.Errorf("Invalid reconciliation interval: %d", config.ReconcileInterval)
+	}
+
+	// The reconciliation max buffer size must be a non-zero unsigned 32-bit integer.
+	if config.ReconcileMaxBufferSize == 0 {
+		return errors.New("Invalid reconciliation max buffer size: 0")
+	}
+
+	// The reconciliation window must be a positive integer.
+	if config.ReconcileWindow <= 0 {
+		return fmt.Errorf("Invalid reconciliation window: %d", config.ReconcileWindow)
+	}
+
+	// The summary of the reconciliation window must fit in the reconciliation
+	// max buffer size, or else peers cannot read it.
+	if size := bloomFilterSize(config.ReconcileWindow); uint64(size) > uint64(config.ReconcileMaxBufferSize) {
+		return fmt.Errorf("Invalid reconciliation window: %d byte summary exceeds max buffer size", size)
+	}
+
+	// The restore timeout must be a positive time duration.
+	if config.RestoreTimeout <= 0 {
+		return fmt.Errorf("Invalid restore timeout: %d", config.RestoreTimeout)
+	}
+
+	// The rings base latency must be a positive time duration.
+	if config.RingsBaseLatency <= 0 {
+		return fmt.Errorf("Invalid rings base latency: %d", config.RingsBaseLatency)
+	}
+
+	// The rings capacity must be a non-negative integer.
+	if config.RingsCapacity < 0 {
+		return fmt.Errorf("Invalid rings capacity: %d", config.RingsCapacity)
+	}
+
+	// The rings count must be a positive integer.
+	if config.RingsCount <= 0 {
+		return fmt.Errorf("Invalid rings count: %d", config.RingsCount)
+	}
+
+	// The rings hysteresis must be a non-negative number less than one.
+	if config.RingsHysteresis < 0 || config.RingsHysteresis >= 1 {
+		return fmt.Errorf("Invalid rings hysteresis: %f", config.RingsHysteresis)
+	}
+
+	// The rings latency growth factor must be greater than one.
+	if config.RingsLatencyGrowthFactor <= 1 {
+		return fmt.Errorf("Invalid rings latency growth factor: %f", config.RingsLatencyGrowthFactor)
+	}
+
+	// The rings max failures must be a non-negative integer.
+	if config.RingsMaxFailures < 0 {
+		return fmt.Errorf("Invalid rings max failures: %d", config.RingsMaxFailures)
+	}
+
+	// The rings probe queue size must be a positive integer.
+	if config.RingsProbeQueueSize <= 0 {
+		return fmt.Errorf("Invalid rings probe queue size: %d", config.RingsProbeQueueSize)
+	}
+
+	// The rings probe workers must be a positive integer.
+	if config.RingsProbeWorkers <= 0 {
+		return fmt.Errorf("Invalid rings probe workers: %d", config.RingsProbeWorkers)
+	}
+
+	// The rings replacement cache size must be a non-negative integer.
+	if config.RingsReplacementCacheSize < 0 {
+		return fmt.Errorf("Invalid rings replacement cache size: %d", config.RingsReplacementCacheSize)
+	}
+
+	// The rings reputation decay must be a number in the range (0, 1].
+	if config.RingsReputationDecay <= 0 || config.RingsReputationDecay > 1 {
+		return fmt.Errorf("Invalid rings reputation decay: %f", config.RingsReputationDecay)
+	}
+
+	// The rings reputation history size must be a positive integer.
+	if config.RingsReputationHistorySize <= 0 {
+		return fmt.Errorf("Invalid rings reputation history size: %d", config.RingsReputationHistorySize)
+	}
+
+	// The rings sample period must be a positive time duration.
+	if config.RingsSamplePeriod <= 0 {
+		return fmt.Errorf("Invalid rings sample period: %d", config.RingsSamplePeriod)
+	}
+
+	// The rings sample size must be a positive integer.
+	if config.RingsSampleSize <= 0 {
+		return fmt.Errorf("Invalid rings sample size: %d", config.RingsSampleSize)
+	}
+
+	// The rings silence timeout must be a non-negative time duration.
+	if config.RingsSilenceTimeout < 0 {
+		return fmt.Errorf("Invalid rings silence timeout: %d", config.RingsSilenceTimeout)
+	}
+
 	// The peer sample max buffer size must be a non-zero unsigned 32-bit integer.
 	if config.SampleMaxBufferSize == 0 {
 		return errors.New("Invalid peer sample max buffer size: 0")
@@ -188,6 +435,39 @@ func (config *Config) validate() error {
 		}
 	}
 
+	// The stream eviction grace period must be a non-negative time duration.
+	if config.StreamEvictionGracePeriod < 0 {
+		return fmt.Errorf("Invalid stream eviction grace period: %d", config.StreamEvictionGracePeriod)
+	}
+
+	// The stream eviction interval must be a non-negative time duration.
+	if config.StreamEvictionInterval < 0 {
+		return fmt.Errorf("Invalid stream eviction interval: %d", config.StreamEvictionInterval)
+	}
+
+	// The stream eviction margin must be a non-negative number.
+	if config.StreamEvictionMargin < 0 {
+		return fmt.Errorf("Invalid stream eviction margin: %f", config.StreamEvictionMargin)
+	}
+
+	// The stream heartbeat interval must be a non-negative time duration,
+	// where zero disables heartbeats.
+	if config.StreamHeartbeatInterval < 0 {
+		return fmt.Errorf("Invalid stream heartbeat interval: %d", config.StreamHeartbeatInterval)
+	}
+
+	// The stream idle timeout must be a non-negative time duration, where zero
+	// disables it, and must exceed the stream heartbeat interval if both are
+	// enabled.
+	if config.StreamIdleTimeout < 0 || config.StreamIdleTimeout > 0 && config.StreamHeartbeatInterval > 0 && config.StreamIdleTimeout <= config.StreamHeartbeatInterval {
+		return fmt.Errorf("Invalid stream idle timeout: %d", config.StreamIdleTimeout)
+	}
+
+	// The stream request max buffer size must fit a ping.
+	if config.StreamRequestMaxBufferSize <= config.PingBufferSize {
+		return fmt.Errorf("Invalid stream request max buffer size: %d", config.StreamRequestMaxBufferSize)
+	}
+
 	// The stream store inbound capacity must be a positive integer.
 	if config.StreamstoreInboundCapacity <= 0 {
 		return fmt.Errorf("Invalid stream store inbound capacity: %d", config.StreamstoreInboundCapacity)
@@ -203,11 +483,29 @@ func (config *Config) validate() error {
 		return fmt.Errorf("Invalid stream store transaction queue size: %d", config.StreamstoreQueueSize)
 	}
 
+	// The stream store reserved inbound capacity must be a non-negative integer.
+	if config.StreamstoreReservedInbound < 0 {
+		return fmt.Errorf("Invalid stream store reserved inbound capacity: %d", config.StreamstoreReservedInbound)
+	}
+
+	// The stream store reserved outbound capacity must be a non-negative integer.
+	if config.StreamstoreReservedOutbound < 0 {
+		return fmt.Errorf("Invalid stream store reserved outbound capacity: %d", config.StreamstoreReservedOutbound)
+	}
+
 	// The stream timeout must be a positive time duration.
 	if config.Timeout <= 0 {
 		return fmt.Errorf("Invalid stream timeout: %d", config.Timeout)
 	}
 
+	// The trusted peers must be parsable.
+	for i := range config.TrustedPeers {
+		_, err = peer.IDB58Decode(config.TrustedPeers[i])
+		if err != nil {
+			return fmt.Errorf("Invalid trusted peer: %s", config.TrustedPeers[i])
+		}
+	}
+
 	// The witness cache size must be a positive integer.
 	if config.WitnessCacheSize <= 0 {
 		return fmt.Errorf("Invalid witness cache size: %d", config.WitnessCacheSize)
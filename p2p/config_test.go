@@ -0,0 +1,40 @@
+/**
+ * File        : config_test.go
+ * Description : Unit tests.
+ * Copyright   : Copyright (c) 2017-2018 DFINITY Stiftung. All rights reserved.
+ * Maintainer  : Enzo Haussecker <enzo@dfinity.org>
+ * Stability   : Experimental
+ */
+
+package p2p
+
+import (
+	"testing"
+	"time"
+)
+
+// Show that heartbeats and the idle timeout can be disabled, but that an
+// enabled idle timeout must exceed an enabled heartbeat interval.
+func TestStreamHeartbeatConfig(test *testing.T) {
+
+	valid := [][2]time.Duration{{0, 0}, {0, time.Second}, {time.Second, 0}, {time.Second, 2 * time.Second}}
+	for _, durations := range valid {
+		config := DefaultConfig()
+		config.StreamHeartbeatInterval = durations[0]
+		config.StreamIdleTimeout = durations[1]
+		if err := config.validate(); err != nil {
+			test.Fatal(durations, err)
+		}
+	}
+
+	invalid := [][2]time.Duration{{-time.Second, 0}, {0, -time.Second}, {2 * time.Second, time.Second}}
+	for _, durations := range invalid {
+		config := DefaultConfig()
+		config.StreamHeartbeatInterval = durations[0]
+		config.StreamIdleTimeout = durations[1]
+		if config.validate() == nil {
+			test.Fatal("Accepted an invalid config!", durations)
+		}
+	}
+
+}
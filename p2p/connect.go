@@ -44,12 +44,6 @@ func (client *client) discoverStreams() func() {
 // Replenish the stream store, i.e. fill outbound streams to maximum capacity.
 func (client *client) replenishStreamstore() {
 
-	// We need to pair with this many more peers.
-	need := client.streamstore.OutboundCapacity() - client.streamstore.OutboundSize()
-	if need <= 0 {
-		return
-	}
-
 	// A set of peers that we are already connected with.
 	connectedPeers := make(map[peer.ID]bool)
 	for _, pid := range append(client.streamstore.InboundPeers(),
@@ -57,14 +51,30 @@ func (client *client) replenishStreamstore() {
 		connectedPeers[pid] = true
 	}
 
+	// Pair with the trusted peers first.
+	for _, id := range client.config.TrustedPeers {
+		pid, err := peer.IDB58Decode(id)
+		if err == nil && pid != client.id && !connectedPeers[pid] {
+			client.pair(pid)
+			connectedPeers[pid] = true
+		}
+	}
+
+	// We need to pair with this many more peers.
+	need := client.streamstore.OutboundCapacity() - client.streamstore.OutboundSize()
+	if need <= 0 {
+		return
+	}
+
 	// Iterate through the known peers randomly
 	knownPeers := client.table.ListPeers()
 	perm := rand.Perm(len(knownPeers))
 
 	for i := 0; i < len(knownPeers) && need > 0; i++ {
 		pid := knownPeers[perm[i]]
-		// If we are not already connected with it, connect with it.
-		if !connectedPeers[pid] {
+		// If we are not already connected with it, and it does not share a
+		// network group with too many paired peers, connect with it.
+		if !connectedPeers[pid] && pid != client.id && client.diverse(pid, client.peerstore.Addrs(pid), client.pairedPeers()) {
 			client.pair(pid)
 			need--
 		}
@@ -0,0 +1,95 @@
+/**
+ * File        : control.go
+ * Description : Service for pairing control streams.
+ * Copyright   : Copyright (c) 2017-2018 DFINITY Stiftung. All rights reserved.
+ * Maintainer  : Enzo Haussecker <enzo@dfinity.org>
+ * Stability   : Experimental
+ */
+
+package p2p
+
+import (
+	"io"
+
+	"gx/ipfs/QmNa31VPzC561NWwRsJLE7nGYZYuuD2QfpK2b1q9BK54J1/go-libp2p-net"
+	"gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
+)
+
+// A lane is a set of stream store functions for sending artifacts.
+type lane struct {
+	apply   func(func(peer.ID, io.Writer) error, peer.IDSlice) map[peer.ID]chan error
+	applyN  func(func(peer.ID, io.Writer) error, int, peer.IDSlice) map[peer.ID]chan error
+	applyTo func(func(peer.ID, io.Writer) error, peer.IDSlice) map[peer.ID]chan error
+}
+
+// Get the lane for an artifact of the given size. Small artifacts take the
+// control lane, so that they do not queue behind bulk transfers.
+func (client *client) lane(size uint32) lane {
+	if size <= client.config.ControlMaxArtifactSize {
+		return lane{
+			client.streamstore.ApplyControl,
+			client.streamstore.ApplyControlN,
+			client.streamstore.ApplyControlTo,
+		}
+	}
+	return lane{
+		client.streamstore.Apply,
+		client.streamstore.ApplyN,
+		client.streamstore.ApplyTo,
+	}
+}
+
+// Open a control stream to a paired peer.
+func (client *client) openControl(peerId peer.ID) {
+
+	// Log this action.
+	pid := peerId
+	client.logger.Debug("Requesting control stream with", pid)
+
+	// Connect to the target peer.
+	stream, err := client.host.NewStream(
+		client.context,
+		pid,
+		client.protocol+"/control",
+	)
+	if err != nil {
+		client.logger.Debug("Cannot connect to", pid, err)
+		return
+	}
+
+	// Add the control stream to the stream store.
+	if !client.streamstore.AddControl(pid, stream) {
+		client.logger.Debug("Cannot add control stream for", pid)
+		stream.Close()
+		return
+	}
+
+	// Process artifacts from the control stream.
+	client.process(stream)
+
+}
+
+// Handle incomming control streams.
+func (client *client) controlHandler(stream net.Stream) {
+
+	// Log this action.
+	pid := stream.Conn().RemotePeer()
+	client.logger.Debug("Receiving control stream from", pid)
+
+	// Add the control stream to the stream store.
+	if !client.streamstore.AddControl(pid, stream) {
+		client.logger.Debug("Cannot add control stream for", pid)
+		stream.Close()
+		return
+	}
+
+	// Process artifacts from the control stream.
+	client.process(stream)
+
+}
+
+// Register the control stream handler.
+func (client *client) registerControlService() {
+	uri := client.protocol + "/control"
+	client.host.SetStreamHandler(uri, client.controlHandler)
+}
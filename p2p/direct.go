@@ -0,0 +1,145 @@
+/**
+ * File        : direct.go
+ * Description : Service for sending artifacts to specific peers.
+ * Copyright   : Copyright (c) 2017-2018 DFINITY Stiftung. All rights reserved.
+ * Maintainer  : Enzo Haussecker <enzo@dfinity.org>
+ * Stability   : Experimental
+ */
+
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"gx/ipfs/QmNa31VPzC561NWwRsJLE7nGYZYuuD2QfpK2b1q9BK54J1/go-libp2p-net"
+	"gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
+
+	"github.com/dfinity/go-revolver/artifact"
+)
+
+// SendTo -- Send an artifact to specific peers. Paired peers receive the
+// artifact over their existing streams. Everyone else receives it over a
+// temporary stream. Invalid and unreachable peers are recorded as failed in
+// the receipt. The artifact is not consumed if an error is returned.
+func (client *client) SendTo(peers []string, object artifact.Artifact) (*Receipt, error) {
+
+	// Encode the artifact header if the artifact may travel any further.
+	header, ok := client.header(object)
+	if !ok {
+		return nil, errors.New("Cannot send artifact: hop limit reached")
+	}
+
+	// Decode the peer identifiers.
+	receipt := newReceipt(object.Checksum())
+	var pids peer.IDSlice
+	for i := range peers {
+		pid, err := peer.IDB58Decode(peers[i])
+		if err != nil {
+			receipt.failID(peers[i], fmt.Errorf("Invalid peer: %s", peers[i]))
+			continue
+		}
+		pids = append(pids, pid)
+	}
+
+	// Update the artifact cache.
+	client.artifactCacheLock.Lock()
+	client.artifactCache.Add(object.Checksum(), routeOf(object))
+	client.artifactCacheLock.Unlock()
+
+	// Create a shipment to share the chunks between transfers.
+	s := client.newShipment(client.lane(object.Size()), header, client.chunks(object.Size()))
+
+	// Send the artifact to paired peers and record the results as they come.
+	var group sync.WaitGroup
+	results := s.lane.applyTo(client.writeShipment(s), pids)
+	group.Add(1)
+	go func() {
+		defer group.Done()
+		client.collect(s, results, nil, false, receipt)
+	}()
+
+	// Send the artifact to everyone else over temporary streams.
+	unpaired := make(map[peer.ID]bool)
+	for _, pid := range pids {
+		if _, exists := results[pid]; exists || unpaired[pid] {
+			continue
+		}
+		unpaired[pid] = true
+		group.Add(1)
+		go func(pid peer.ID) {
+			defer group.Done()
+			err := client.deliver(pid, header, s.buffer)
+			if err != nil {
+				receipt.fail(pid, err)
+			} else {
+				receipt.deliver(pid)
+			}
+		}(pid)
+	}
+
+	// Finish the receipt once every peer has a result.
+	go func() {
+		group.Wait()
+		receipt.finish()
+	}()
+
+	// Read the artifact into the buffer.
+	err := client.fill(object, s.buffer)
+	if err != nil {
+		client.logger.Warning("Cannot read artifact", err)
+		object.Disconnect()
+	} else {
+		object.Close()
+	}
+
+	// Return the receipt.
+	return receipt, nil
+
+}
+
+// Deliver an artifact to a peer over a temporary stream.
+func (client *client) deliver(peerId peer.ID, header []byte, buffer *chunkBuffer) error {
+
+	// Log this action.
+	pid := peerId
+	client.logger.Debug("Delivering artifact to", pid)
+
+	// Connect to the target peer.
+	stream, err := client.host.NewStream(
+		client.context,
+		pid,
+		client.protocol+"/deliver",
+	)
+	if err != nil {
+		addrs := client.peerstore.PeerInfo(pid).Addrs
+		client.logger.Debug("Cannot connect to", pid, "at", addrs, err)
+		return err
+	}
+	defer stream.Close()
+
+	// Send the artifact to the target peer.
+	return client.transfer(stream, header, buffer)
+
+}
+
+// Handle incomming deliveries.
+func (client *client) deliverHandler(stream net.Stream) {
+
+	defer stream.Close()
+
+	// Log this action.
+	pid := stream.Conn().RemotePeer()
+	client.logger.Debug("Receiving delivery from", pid)
+
+	// Process artifacts until the target peer closes the stream.
+	client.consume(stream)
+
+}
+
+// Register the delivery handler.
+func (client *client) registerDeliverService() {
+	uri := client.protocol + "/deliver"
+	client.host.SetStreamHandler(uri, client.deliverHandler)
+}
@@ -0,0 +1,204 @@
+/**
+ * File        : direct_test.go
+ * Description : Unit tests.
+ * Copyright   : Copyright (c) 2017-2018 DFINITY Stiftung. All rights reserved.
+ * Maintainer  : Enzo Haussecker <enzo@dfinity.org>
+ * Stability   : Experimental
+ */
+
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"gx/ipfs/QmPgDWmTmuzvP7QE5zwo1TmjbJme9pmZHNujB2453jkCTr/go-libp2p-peerstore"
+
+	"github.com/dfinity/go-revolver/artifact"
+)
+
+// Show that a client can send an artifact to a peer that it is not paired
+// with.
+func TestSendTo(test *testing.T) {
+
+	// Create a client.
+	client1, shutdown1 := newTestClient(test)
+	defer shutdown1()
+
+	// Create a second client.
+	client2, shutdown2 := newTestClient(test)
+	defer shutdown2()
+
+	// Add the second client to the peer store of the first.
+	client1.peerstore.AddAddrs(
+		client2.id,
+		client2.host.Addrs(),
+		peerstore.ProviderAddrTTL,
+	)
+
+	// Create an artifact.
+	dataOut := []byte("This is a test.")
+	artifactOut, err := artifact.FromBytes(dataOut, false)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	// Send the artifact to the second client.
+	receipt, err := client1.SendTo([]string{client2.ID()}, artifactOut)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	select {
+
+	// Wait for the second client to receive the artifact.
+	case artifactIn := <-client2.receive:
+
+		// Create a byte slice from the artifact.
+		dataIn, err := artifact.ToBytes(artifactIn)
+		if err != nil {
+			test.Fatal(err)
+		}
+
+		// Verify that the data sent and received is the same.
+		if !bytes.Equal(dataOut, dataIn) {
+			test.Fatal("Corrupt artifact!")
+		}
+
+	case <-time.After(time.Second):
+		test.Fatal("Missing artifact!")
+
+	}
+
+	// Verify that the receipt reports the delivery.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = receipt.Wait(ctx)
+	if err != nil {
+		test.Fatal(err)
+	}
+	delivered := receipt.Delivered()
+	if len(delivered) != 1 || delivered[0] != client2.ID() {
+		test.Fatal("Unexpected receipt!", delivered, receipt.Failed())
+	}
+
+}
+
+// Show that a client can send an artifact to a peer that it is paired with.
+func TestSendToPaired(test *testing.T) {
+
+	// Create a client.
+	client1, shutdown1 := newTestClient(test)
+	defer shutdown1()
+
+	// Create a second client.
+	client2, shutdown2 := newTestClient(test)
+	defer shutdown2()
+
+	// Add the second client to the peer store of the first.
+	client1.peerstore.AddAddrs(
+		client2.id,
+		client2.host.Addrs(),
+		peerstore.ProviderAddrTTL,
+	)
+
+	// Pair the first and second client.
+	success, err := client1.pair(client2.id)
+	if err != nil || !success {
+		test.Fatal(err)
+	}
+
+	// Create an artifact.
+	dataOut := []byte("This is a test.")
+	artifactOut, err := artifact.FromBytes(dataOut, false)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	// Send the artifact to the second client.
+	receipt, err := client1.SendTo([]string{client2.ID()}, artifactOut)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	select {
+
+	// Wait for the second client to receive the artifact.
+	case artifactIn := <-client2.receive:
+
+		// Create a byte slice from the artifact.
+		dataIn, err := artifact.ToBytes(artifactIn)
+		if err != nil {
+			test.Fatal(err)
+		}
+
+		// Verify that the data sent and received is the same.
+		if !bytes.Equal(dataOut, dataIn) {
+			test.Fatal("Corrupt artifact!")
+		}
+
+	case <-time.After(time.Second):
+		test.Fatal("Missing artifact!")
+
+	}
+
+	// Verify that the receipt reports the delivery and its timing.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = receipt.Wait(ctx)
+	if err != nil {
+		test.Fatal(err)
+	}
+	delivered := receipt.Delivered()
+	if len(delivered) != 1 || delivered[0] != client2.ID() {
+		test.Fatal("Unexpected receipt!", delivered, receipt.Failed())
+	}
+	if _, exists := receipt.Elapsed()[client2.ID()]; !exists {
+		test.Fatal("Missing elapsed time!")
+	}
+
+}
+
+// Show that invalid and unreachable peers are recorded as failed.
+func TestSendToFailed(test *testing.T) {
+
+	// Create a client.
+	client1, shutdown1 := newTestClient(test)
+	defer shutdown1()
+
+	// Create a second client, which shuts down before the transfer.
+	client2, shutdown2 := newTestClient(test)
+	unreachable := client2.ID()
+	shutdown2()
+
+	// Create an artifact.
+	artifactOut, err := artifact.FromBytes([]byte("This is a test."), false)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	// Send the artifact to an invalid and an unreachable peer.
+	invalid := "not-a-peer"
+	receipt, err := client1.SendTo([]string{invalid, unreachable}, artifactOut)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	// Verify that the receipt reports both failures.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = receipt.Wait(ctx)
+	if err != nil {
+		test.Fatal(err)
+	}
+	failed := receipt.Failed()
+	if len(failed) != 2 || failed[invalid] == nil || failed[unreachable] == nil {
+		test.Fatal("Unexpected receipt!", receipt.Delivered(), failed)
+	}
+	if len(receipt.Delivered()) != 0 {
+		test.Fatal("Unexpected delivery!", receipt.Delivered())
+	}
+
+}
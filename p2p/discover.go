@@ -83,6 +83,11 @@ func (client *client) replenishRoutingTable(queries int) {
 					continue
 				}
 
+				// Prevent a network group from dominating the routing table.
+				if !client.diverse(sample[j].ID, sample[j].Addrs, client.table.ListPeers()) {
+					continue
+				}
+
 				// Temporarily add the peer to the peer store.
 				client.peerstore.AddAddrs(
 					sample[j].ID,
@@ -104,7 +109,7 @@ func (client *client) replenishRoutingTable(queries int) {
 				)
 
 				// Update the routing table.
-				client.table.Update(sample[j].ID)
+				client.update(sample[j].ID)
 
 			}
 
@@ -0,0 +1,230 @@
+/**
+ * File        : diversity.go
+ * Description : Network diversity rules against eclipse attacks.
+ * Copyright   : Copyright (c) 2017-2018 DFINITY Stiftung. All rights reserved.
+ * Maintainer  : Enzo Haussecker <enzo@dfinity.org>
+ * Stability   : Experimental
+ */
+
+package p2p
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gx/ipfs/QmXY77cVe7rVRQXZZQRioukUM7aRW3BTcAgJe12MCtb3Ji/go-multiaddr"
+	"gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
+)
+
+// This type identifies the kind of network group that an address belongs to.
+type groupKind int
+
+const (
+	ipv4Subnet16 groupKind = iota
+	ipv4Subnet24
+	ipv6Subnet48
+	autonomousSystem
+)
+
+// This type represents a network group, e.g. a subnet or an autonomous system.
+type group struct {
+	kind groupKind
+	id   string
+}
+
+// Private IPv4 and unique local IPv6 addresses, which belong to no group.
+var privateNetworks = []net.IPNet{
+	{IP: net.IP{10, 0, 0, 0}, Mask: net.CIDRMask(8, 32)},
+	{IP: net.IP{172, 16, 0, 0}, Mask: net.CIDRMask(12, 32)},
+	{IP: net.IP{192, 168, 0, 0}, Mask: net.CIDRMask(16, 32)},
+	{IP: net.IP{0xfc, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, Mask: net.CIDRMask(7, 128)},
+}
+
+// Check if an IP address is private.
+func isPrivate(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// This type maps IP prefixes to autonomous system numbers.
+type asnTable struct {
+	lengths  []int
+	prefixes map[int]map[string]uint32
+}
+
+// Load a table of autonomous system numbers from a file. Each line holds an IP
+// prefix in CIDR notation followed by an autonomous system number, e.g.
+// "192.0.2.0/24 AS64496". Empty lines and lines that start with "#" are
+// ignored.
+func loadASNTable(path string) (*asnTable, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// Parse the prefixes.
+	table := &asnTable{prefixes: make(map[int]map[string]uint32)}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Invalid ASN prefix in %s at line %d", path, line)
+		}
+		_, subnet, err := net.ParseCIDR(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid ASN prefix in %s at line %d: %v", path, line, err)
+		}
+		asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(fields[1]), "AS"), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid ASN in %s at line %d: %v", path, line, err)
+		}
+		table.insert(subnet, uint32(asn))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// Prefer the longest matching prefix.
+	sort.Sort(sort.Reverse(sort.IntSlice(table.lengths)))
+	return table, nil
+
+}
+
+// Add a prefix to the table.
+func (table *asnTable) insert(subnet *net.IPNet, asn uint32) {
+	ones, bits := subnet.Mask.Size()
+	length := ones + 128 - bits
+	if _, exists := table.prefixes[length]; !exists {
+		table.prefixes[length] = make(map[string]uint32)
+		table.lengths = append(table.lengths, length)
+	}
+	table.prefixes[length][string(subnet.IP.To16())] = asn
+}
+
+// Look up the autonomous system number of an IP address.
+func (table *asnTable) lookup(ip net.IP) (uint32, bool) {
+	ip = ip.To16()
+	for _, length := range table.lengths {
+		masked := ip.Mask(net.CIDRMask(length, 128))
+		asn, exists := table.prefixes[length][string(masked)]
+		if exists {
+			return asn, true
+		}
+	}
+	return 0, false
+}
+
+// Get the network groups of a set of addresses. Loopback, private and
+// link-local addresses belong to no group.
+func (client *client) groups(addrs []multiaddr.Multiaddr) map[group]bool {
+
+	result := make(map[group]bool)
+	for _, addr := range addrs {
+
+		// Extract the IP address.
+		value, err := addr.ValueForProtocol(multiaddr.P_IP4)
+		if err != nil {
+			value, err = addr.ValueForProtocol(multiaddr.P_IP6)
+			if err != nil {
+				continue
+			}
+		}
+		ip := net.ParseIP(value)
+		if ip == nil || !ip.IsGlobalUnicast() || isPrivate(ip) {
+			continue
+		}
+
+		// Determine the subnets.
+		if ip4 := ip.To4(); ip4 != nil {
+			result[group{ipv4Subnet16, ip4.Mask(net.CIDRMask(16, 32)).String()}] = true
+			result[group{ipv4Subnet24, ip4.Mask(net.CIDRMask(24, 32)).String()}] = true
+		} else {
+			result[group{ipv6Subnet48, ip.Mask(net.CIDRMask(48, 128)).String()}] = true
+		}
+
+		// Determine the autonomous system.
+		if client.asnTable != nil {
+			asn, exists := client.asnTable.lookup(ip)
+			if exists {
+				result[group{autonomousSystem, strconv.FormatUint(uint64(asn), 10)}] = true
+			}
+		}
+
+	}
+
+	return result
+
+}
+
+// Get the maximum number of peers in a network group, or zero if unlimited.
+func (client *client) groupLimit(kind groupKind) int {
+	switch kind {
+	case ipv4Subnet16:
+		return client.config.DiversityMaxPerIPv4Subnet16
+	case ipv4Subnet24:
+		return client.config.DiversityMaxPerIPv4Subnet24
+	case ipv6Subnet48:
+		return client.config.DiversityMaxPerIPv6Subnet48
+	case autonomousSystem:
+		return client.config.DiversityMaxPerASN
+	}
+	return 0
+}
+
+// Check if a peer with the given addresses can join a set of peers without
+// exceeding the limit of any network group.
+func (client *client) diverse(pid peer.ID, addrs []multiaddr.Multiaddr, peers []peer.ID) bool {
+
+	// Get the network groups of the peer.
+	candidate := client.groups(addrs)
+	if len(candidate) == 0 {
+		return true
+	}
+
+	// Count the other peers in those groups.
+	counts := make(map[group]int)
+	for _, other := range peers {
+		if other == pid || other == client.id {
+			continue
+		}
+		for g := range client.groups(client.peerstore.Addrs(other)) {
+			if candidate[g] {
+				counts[g]++
+			}
+		}
+	}
+
+	// Check the limits.
+	for g := range candidate {
+		limit := client.groupLimit(g.kind)
+		if limit > 0 && counts[g] >= limit {
+			client.logger.Debug("Too many peers in the network group of", pid)
+			return false
+		}
+	}
+
+	return true
+
+}
+
+// Get the peers that are paired with the client.
+func (client *client) pairedPeers() []peer.ID {
+	return append(client.streamstore.InboundPeers(), client.streamstore.OutboundPeers()...)
+}
@@ -0,0 +1,129 @@
+/**
+ * File        : diversity_test.go
+ * Description : Unit tests.
+ * Copyright   : Copyright (c) 2017-2018 DFINITY Stiftung. All rights reserved.
+ * Maintainer  : Enzo Haussecker <enzo@dfinity.org>
+ * Stability   : Experimental
+ */
+
+package p2p
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/enzoh/go-logging"
+	"gx/ipfs/QmPgDWmTmuzvP7QE5zwo1TmjbJme9pmZHNujB2453jkCTr/go-libp2p-peerstore"
+	"gx/ipfs/QmXY77cVe7rVRQXZZQRioukUM7aRW3BTcAgJe12MCtb3Ji/go-multiaddr"
+	"gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
+)
+
+// Show that peers in the same subnet are limited, and that private addresses
+// are exempt.
+func TestDiversity(test *testing.T) {
+
+	client := &client{
+		config:    DefaultConfig(),
+		logger:    logging.MustGetLogger("p2p"),
+		peerstore: peerstore.NewPeerstore(),
+	}
+	client.config.DiversityMaxPerIPv4Subnet24 = 2
+
+	addrs := func(ip string) []multiaddr.Multiaddr {
+		addr, err := multiaddr.NewMultiaddr(fmt.Sprintf("/ip4/%s/tcp/4001", ip))
+		if err != nil {
+			test.Fatal(err)
+		}
+		return []multiaddr.Multiaddr{addr}
+	}
+
+	// Fill a /24 subnet.
+	var peers []peer.ID
+	for i := 0; i < 2; i++ {
+		pid := peer.ID(fmt.Sprintf("peer-%d", i))
+		client.peerstore.AddAddrs(pid, addrs(fmt.Sprintf("203.0.113.%d", i+1)), peerstore.PermanentAddrTTL)
+		peers = append(peers, pid)
+	}
+
+	if client.diverse("candidate", addrs("203.0.113.9"), peers) {
+		test.Fatal("Admitted a third peer from the same /24 subnet")
+	}
+	if !client.diverse("candidate", addrs("198.51.100.9"), peers) {
+		test.Fatal("Rejected a peer from another /24 subnet")
+	}
+	if !client.diverse(peers[0], addrs("203.0.113.1"), peers) {
+		test.Fatal("Rejected a peer that is already counted")
+	}
+
+	// Private addresses belong to no group.
+	for i := 0; i < 4; i++ {
+		pid := peer.ID(fmt.Sprintf("local-%d", i))
+		client.peerstore.AddAddrs(pid, addrs(fmt.Sprintf("10.0.0.%d", i+1)), peerstore.PermanentAddrTTL)
+		peers = append(peers, pid)
+	}
+	if !client.diverse("candidate", addrs("10.0.0.9"), peers) {
+		test.Fatal("Rejected a peer with a private address")
+	}
+
+}
+
+// Show that the longest matching prefix determines the ASN.
+func TestASNTable(test *testing.T) {
+
+	file, err := ioutil.TempFile("", "asn")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	fmt.Fprintln(file, "# prefix asn")
+	fmt.Fprintln(file, "203.0.0.0/8 AS64496")
+	fmt.Fprintln(file, "203.0.113.0/24 64497")
+	fmt.Fprintln(file, "2001:db8::/32 AS64498")
+	file.Close()
+
+	table, err := loadASNTable(file.Name())
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	for ip, expected := range map[string]uint32{
+		"203.0.113.7": 64497,
+		"203.1.2.3":   64496,
+		"2001:db8::1": 64498,
+	} {
+		asn, exists := table.lookup(net.ParseIP(ip))
+		if !exists || asn != expected {
+			test.Fatal("Wrong ASN for", ip, asn)
+		}
+	}
+	if _, exists := table.lookup(net.ParseIP("198.51.100.1")); exists {
+		test.Fatal("Found an ASN for an unknown prefix")
+	}
+
+}
+
+// Show that private IPv4 and unique local IPv6 addresses are recognized.
+func TestPrivateAddresses(test *testing.T) {
+
+	for addr, expected := range map[string]bool{
+		"10.1.2.3":       true,
+		"172.16.0.1":     true,
+		"172.31.255.255": true,
+		"172.32.0.1":     false,
+		"192.168.1.1":    true,
+		"192.169.1.1":    false,
+		"8.8.8.8":        false,
+		"fc00::1":        true,
+		"fd12:3456::1":   true,
+		"fe80::1":        false,
+		"2001:db8::1":    false,
+	} {
+		if isPrivate(net.ParseIP(addr)) != expected {
+			test.Fatal("Wrong classification!", addr)
+		}
+	}
+
+}
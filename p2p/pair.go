@@ -12,6 +12,7 @@ import (
 	"fmt"
 
 	"gx/ipfs/QmNa31VPzC561NWwRsJLE7nGYZYuuD2QfpK2b1q9BK54J1/go-libp2p-net"
+	"gx/ipfs/QmXY77cVe7rVRQXZZQRioukUM7aRW3BTcAgJe12MCtb3Ji/go-multiaddr"
 	"gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
 
 	"github.com/dfinity/go-revolver/util"
@@ -64,6 +65,11 @@ func (client *client) pair(peerId peer.ID) (bool, error) {
 		go client.process(stream)
 		success = true
 
+		// Open a control stream for latency-sensitive traffic.
+		if !client.config.DisableControlStream {
+			go client.openControl(pid)
+		}
+
 	} else {
 
 		// Cannot pair with the target peer.
@@ -99,6 +105,13 @@ func (client *client) pairHandler(stream net.Stream) {
 		stream.Close()
 	}
 
+	// Prevent a network group from dominating the stream store.
+	addrs := []multiaddr.Multiaddr{stream.Conn().RemoteMultiaddr()}
+	if !client.streamstore.Trusted(pid) && !client.diverse(pid, addrs, client.pairedPeers()) {
+		reject(pid, " shares a network group with too many peers")
+		return
+	}
+
 	// Add the inbound stream to the stream store.
 	if !client.streamstore.Add(pid, stream, false) {
 		reject(pid, " cannot be added to the stream store")
@@ -113,7 +126,7 @@ func (client *client) pairHandler(stream net.Stream) {
 	)
 	if err != nil {
 		client.logger.Warning("Cannot send data to", pid, err)
-		client.streamstore.Remove(pid)
+		client.streamstore.RemoveStream(pid, stream)
 		return
 	}
 
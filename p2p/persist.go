@@ -0,0 +1,359 @@
+/**
+ * File        : persist.go
+ * Description : Persistence of known peers across restarts.
+ * Copyright   : Copyright (c) 2017-2018 DFINITY Stiftung. All rights reserved.
+ * Maintainer  : Enzo Haussecker <enzo@dfinity.org>
+ * Stability   : Experimental
+ */
+
+package p2p
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"gx/ipfs/QmPgDWmTmuzvP7QE5zwo1TmjbJme9pmZHNujB2453jkCTr/go-libp2p-peerstore"
+	"gx/ipfs/QmXY77cVe7rVRQXZZQRioukUM7aRW3BTcAgJe12MCtb3Ji/go-multiaddr"
+	"gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
+)
+
+// The name of the peer file in the data directory.
+const peerFileName = "peers.json"
+
+// The number of persisted peers that are pinged at once while bootstrapping.
+const peerFileConcurrency = 16
+
+// The time before an anchor peer is greeted again, which doubles with every
+// attempt.
+const anchorRetryBackoff = time.Second
+
+// This type represents a known peer in the peer file.
+type peerRecord struct {
+	ID       string        `json:"id"`
+	Addrs    []string      `json:"addrs"`
+	Latency  time.Duration `json:"latency"`
+	LastSeen time.Time     `json:"lastSeen"`
+}
+
+// Record the time a peer was last seen, if the peers are saved, and update the
+// routing table.
+func (client *client) update(pid peer.ID) {
+	if client.config.DataDir != "" {
+		client.lastSeenLock.Lock()
+		client.lastSeen[pid] = time.Now()
+		client.lastSeenLock.Unlock()
+	}
+	client.table.Update(pid)
+}
+
+// Get the path of the peer file.
+func (client *client) peerFile() string {
+	return filepath.Join(client.config.DataDir, peerFileName)
+}
+
+// Save the known peers to the peer file.
+func (client *client) savePeers() error {
+
+	// Create a record for each peer in the routing table.
+	pids := client.table.ListPeers()
+	records := make([]peerRecord, 0, len(pids))
+	client.lastSeenLock.Lock()
+	for _, pid := range pids {
+		if pid == client.id {
+			continue
+		}
+		record := peerRecord{
+			ID:       pid.Pretty(),
+			Latency:  client.peerstore.LatencyEWMA(pid),
+			LastSeen: client.lastSeen[pid],
+		}
+		for _, addr := range client.peerstore.Addrs(pid) {
+			record.Addrs = append(record.Addrs, addr.String())
+		}
+		if len(record.Addrs) != 0 {
+			records = append(records, record)
+		}
+	}
+	client.lastSeenLock.Unlock()
+
+	// Keep the most recently seen peers.
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].LastSeen.After(records[j].LastSeen)
+	})
+	if len(records) > client.config.PeerFileSize {
+		records = records[:client.config.PeerFileSize]
+	}
+
+	// Forget when the other peers were last seen.
+	kept := make(map[string]bool, len(records))
+	for _, record := range records {
+		kept[record.ID] = true
+	}
+	client.lastSeenLock.Lock()
+	for pid := range client.lastSeen {
+		if !kept[pid.Pretty()] {
+			delete(client.lastSeen, pid)
+		}
+	}
+	client.lastSeenLock.Unlock()
+
+	// Encode the records.
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Replace the peer file atomically.
+	err = os.MkdirAll(client.config.DataDir, 0700)
+	if err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(client.config.DataDir, peerFileName)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), client.peerFile())
+
+}
+
+// Load the known peers from the peer file. A missing peer file is not an
+// error.
+func (client *client) loadPeers() ([]peerRecord, error) {
+
+	data, err := ioutil.ReadFile(client.peerFile())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var records []peerRecord
+	err = json.Unmarshal(data, &records)
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+
+}
+
+// Rejoin the network in the background through the anchor peers and the peers
+// from the peer file, until the restore timeout. The anchor peers are greeted
+// first and retried with backoff, while the most recently seen peers from the
+// peer file are pinged. Returns a function that stops the restore.
+func (client *client) restorePeers() func() {
+
+	// Create a shutdown function.
+	ctx, cancel := context.WithTimeout(client.context, client.config.RestoreTimeout)
+	done := make(chan struct{})
+	shutdown := func() {
+		cancel()
+		<-done
+	}
+
+	// Restore the peers until the deadline or the shutdown function is called.
+	go func() {
+		defer close(done)
+		defer cancel()
+
+		// Load the peer file.
+		var records []peerRecord
+		if client.config.DataDir != "" {
+			var err error
+			records, err = client.loadPeers()
+			if err != nil {
+				client.logger.Warning("Cannot load peers from", client.peerFile(), err)
+			}
+		}
+
+		// Greet the anchor peers, and retry those that fail in the meantime.
+		var group, greeted sync.WaitGroup
+		anchors := make(map[peer.ID]bool)
+		for _, node := range client.config.AnchorPeers {
+			address, err := multiaddr.NewMultiaddr(node)
+			if err != nil {
+				continue
+			}
+			_, pid, err := parseIPFSAddress(address)
+			if err != nil {
+				continue
+			}
+			anchors[pid] = true
+			group.Add(1)
+			greeted.Add(1)
+			go func(address multiaddr.Multiaddr) {
+				defer group.Done()
+				client.greetAnchor(ctx, address, greeted.Done)
+			}(address)
+		}
+		waiting := make(chan struct{})
+		go func() {
+			greeted.Wait()
+			close(waiting)
+		}()
+		select {
+		case <-waiting:
+		case <-ctx.Done():
+		}
+
+		// Ping the most recently seen peers first.
+		sort.Slice(records, func(i, j int) bool {
+			return records[i].LastSeen.After(records[j].LastSeen)
+		})
+		tokens := make(chan struct{}, peerFileConcurrency)
+	Restoring:
+		for _, record := range records {
+			pid, err := peer.IDB58Decode(record.ID)
+			if err != nil || pid == client.id || anchors[pid] {
+				continue
+			}
+			var addrs []multiaddr.Multiaddr
+			for _, s := range record.Addrs {
+				addr, err := multiaddr.NewMultiaddr(s)
+				if err == nil {
+					addrs = append(addrs, addr)
+				}
+			}
+			if len(addrs) == 0 {
+				continue
+			}
+			select {
+			case tokens <- struct{}{}:
+			case <-ctx.Done():
+				break Restoring
+			}
+			group.Add(1)
+			go func(pid peer.ID, addrs []multiaddr.Multiaddr, latency time.Duration) {
+				defer func() {
+					<-tokens
+					group.Done()
+				}()
+				client.restorePeer(pid, addrs, latency)
+			}(pid, addrs, record.Latency)
+		}
+		group.Wait()
+
+	}()
+
+	// Return the shutdown function.
+	return shutdown
+
+}
+
+// Greet an anchor peer, and retry with backoff until it answers, the retries
+// run out or the context is done. The first function is called after the
+// first attempt.
+func (client *client) greetAnchor(ctx context.Context, address multiaddr.Multiaddr, first func()) {
+
+	backoff := anchorRetryBackoff
+	for attempt := 0; ; attempt++ {
+
+		// Greet the anchor peer.
+		err := client.hello(address)
+		if attempt == 0 {
+			first()
+		}
+		if err == nil {
+			return
+		}
+		client.logger.Warning("Cannot connect to anchor peer", address, err)
+
+		// Wait before the next attempt.
+		if attempt == client.config.AnchorPeerRetries {
+			return
+		}
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return
+		}
+
+	}
+
+}
+
+// Add a persisted peer to the routing table if it is still reachable.
+func (client *client) restorePeer(pid peer.ID, addrs []multiaddr.Multiaddr, latency time.Duration) {
+
+	// Prevent a network group from dominating the routing table.
+	if !client.diverse(pid, addrs, client.table.ListPeers()) {
+		return
+	}
+
+	// Temporarily add the peer to the peer store.
+	client.peerstore.AddAddrs(pid, addrs, peerstore.TempAddrTTL)
+	if latency > 0 {
+		client.peerstore.RecordLatency(pid, latency)
+	}
+
+	// Ping the peer.
+	err := client.ping(pid)
+	if err != nil {
+		client.logger.Debug("Cannot reach persisted peer", pid, err)
+		return
+	}
+
+	// Add the peer to the peer store.
+	client.peerstore.SetAddrs(pid, addrs, peerstore.ProviderAddrTTL)
+
+	// Update the routing table.
+	client.update(pid)
+
+}
+
+// Periodically save the known peers to the peer file.
+func (client *client) persistPeers() func() {
+
+	// Create a shutdown function, which saves the peers one last time.
+	notify := make(chan struct{})
+	done := make(chan struct{})
+	shutdown := func() {
+		close(notify)
+		<-done
+	}
+
+	// Save the peers until the shutdown function is called.
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(client.config.PeerFileInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-notify:
+			case <-ticker.C:
+			}
+			err := client.savePeers()
+			if err != nil {
+				client.logger.Warning("Cannot save peers to", client.peerFile(), err)
+			}
+			select {
+			case <-notify:
+				return
+			default:
+			}
+		}
+	}()
+
+	// Return the shutdown function.
+	return shutdown
+
+}
@@ -0,0 +1,121 @@
+/**
+ * File        : persist_test.go
+ * Description : Unit tests.
+ * Copyright   : Copyright (c) 2017-2018 DFINITY Stiftung. All rights reserved.
+ * Maintainer  : Enzo Haussecker <enzo@dfinity.org>
+ * Stability   : Experimental
+ */
+
+package p2p
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/enzoh/go-logging"
+	"gx/ipfs/QmPgDWmTmuzvP7QE5zwo1TmjbJme9pmZHNujB2453jkCTr/go-libp2p-peerstore"
+	"gx/ipfs/QmXY77cVe7rVRQXZZQRioukUM7aRW3BTcAgJe12MCtb3Ji/go-multiaddr"
+	"gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
+
+	"github.com/dfinity/go-revolver/routingtable"
+)
+
+// Show that the most recently seen peers survive a round trip through the
+// peer file.
+func TestPeerFile(test *testing.T) {
+
+	dir, err := ioutil.TempDir("", "peers")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	client := &client{
+		config:       DefaultConfig(),
+		id:           peer.ID("self"),
+		lastSeen:     make(map[peer.ID]time.Time),
+		lastSeenLock: &sync.Mutex{},
+		logger:       logging.MustGetLogger("p2p"),
+		peerstore:    peerstore.NewPeerstore(),
+	}
+	client.config.DataDir = dir
+	client.config.PeerFileSize = 2
+	client.table = routingtable.NewKademliaRoutingTable(client.id, routingtable.NewDefaultKademliaConfig(client.peerstore))
+
+	// Add three peers, of which the first was seen least recently.
+	for i := 0; i < 3; i++ {
+		pid := peer.ID(fmt.Sprintf("peer-%d", i))
+		addr, err := multiaddr.NewMultiaddr(fmt.Sprintf("/ip4/10.0.0.%d/tcp/4001", i+1))
+		if err != nil {
+			test.Fatal(err)
+		}
+		client.peerstore.AddAddr(pid, addr, peerstore.PermanentAddrTTL)
+		client.peerstore.RecordLatency(pid, time.Duration(i+1)*time.Millisecond)
+		client.update(pid)
+		time.Sleep(time.Millisecond)
+	}
+
+	err = client.savePeers()
+	if err != nil {
+		test.Fatal(err)
+	}
+	records, err := client.loadPeers()
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	// Verify that the least recently seen peer was dropped.
+	if len(records) != 2 {
+		test.Fatal("Expected 2 records, got", len(records))
+	}
+	client.lastSeenLock.Lock()
+	size := len(client.lastSeen)
+	client.lastSeenLock.Unlock()
+	if size != 2 {
+		test.Fatal("Expected 2 last seen times, got", size)
+	}
+	for i, record := range records {
+		expected := fmt.Sprintf("peer-%d", 2-i)
+		if record.ID != expected || len(record.Addrs) != 1 || record.Latency <= 0 {
+			test.Fatal("Unexpected record", record)
+		}
+	}
+
+}
+
+// Show that unreachable anchor peers do not hold up the bootstrap, and that
+// their retries stop at the restore timeout.
+func TestRestoreTimeout(test *testing.T) {
+
+	// Create a configuration with an unreachable anchor peer.
+	config := DefaultConfig()
+	config.AnchorPeers = []string{"/ip4/127.0.0.1/tcp/1/ipfs/QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN"}
+	config.DisableAnalytics = true
+	config.DisableNATPortMap = true
+	config.DisablePeerDiscovery = true
+	config.DisableStreamDiscovery = true
+	config.IP = "127.0.0.1"
+	config.RestoreTimeout = 100 * time.Millisecond
+
+	// Verify that the client starts while the anchor peer is being retried.
+	start := time.Now()
+	_, shutdown, err := config.create()
+	if err != nil {
+		test.Fatal(err)
+	}
+	if time.Since(start) > time.Second {
+		test.Fatal("Bootstrap waited for the anchor peer!")
+	}
+
+	// Verify that the restore stops at the deadline.
+	start = time.Now()
+	shutdown()
+	if time.Since(start) > 10*time.Second {
+		test.Fatal("Restore outlived its deadline!")
+	}
+
+}
@@ -18,6 +18,7 @@ import (
 	"gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
 
 	"github.com/dfinity/go-revolver/util"
+	"github.com/dfinity/go-revolver/vivaldi"
 )
 
 func (c *client) probeLatency(pid peer.ID) (zero time.Duration, err error) {
@@ -50,32 +51,38 @@ func (c *client) probeLatency(pid peer.ID) (zero time.Duration, err error) {
 	// Observe the current time.
 	before := time.Now()
 
-	// Send data to the target peer.
-	err = util.WriteWithTimeout(stream, wbuf, c.config.Timeout)
+	// Send data and our coordinate to the target peer.
+	coord := c.coordinates.Coordinate().Encode()
+	err = util.WriteWithTimeout(stream, append(wbuf, coord...), c.config.Timeout)
 	if err != nil {
 		c.logger.Warning("Cannot send data to", pid, err)
 		return zero, err
 	}
 
-	// Receive data from the target peer.
+	// Receive data and a coordinate from the target peer.
 	rbuf, err := util.ReadWithTimeout(
 		stream,
-		c.config.PingBufferSize,
+		c.config.PingBufferSize+vivaldi.EncodedSize,
 		c.config.Timeout,
 	)
 	if err != nil {
 		c.logger.Warning("Cannot receive data from", pid, err)
 		return zero, err
 	}
+	latency := time.Since(before)
 
 	// Verify that the data sent and received is the same.
-	if !bytes.Equal(wbuf, rbuf) {
+	if !bytes.Equal(wbuf, rbuf[:c.config.PingBufferSize]) {
 		err = errors.New("Corrupt data!")
 		c.logger.Warning("Cannot verify data received from", pid, err)
 		return zero, err
 	}
 
-	return time.Since(before), nil
+	// Update our coordinate.
+	c.observeCoordinate(pid, rbuf[c.config.PingBufferSize:])
+	c.coordinates.Update(pid, latency)
+
+	return latency, nil
 }
 
 // Ping a peer.
@@ -94,6 +101,16 @@ func (c *client) ping(pid peer.ID) error {
 
 }
 
+// Record the encoded coordinate of a peer.
+func (c *client) observeCoordinate(pid peer.ID, data []byte) {
+	coord, err := vivaldi.Decode(data)
+	if err != nil {
+		c.logger.Debug("Cannot decode coordinate of", pid, err)
+		return
+	}
+	c.coordinates.Observe(pid, coord)
+}
+
 // Handle incomming pings.
 func (c *client) pingHandler(stream net.Stream) {
 
@@ -103,25 +120,27 @@ func (c *client) pingHandler(stream net.Stream) {
 	pid := stream.Conn().RemotePeer()
 	c.logger.Debug("Pong", pid)
 
-	// Receive data from the target peer.
+	// Receive data and a coordinate from the target peer.
 	rbuf, err := util.ReadWithTimeout(
 		stream,
-		c.config.PingBufferSize,
+		c.config.PingBufferSize+vivaldi.EncodedSize,
 		c.config.Timeout,
 	)
 	if err != nil {
 		c.logger.Warning("Cannot receive data from", pid, err)
 		return
 	}
+	c.observeCoordinate(pid, rbuf[c.config.PingBufferSize:])
 
-	// Send data to the target peer.
-	err = util.WriteWithTimeout(stream, rbuf, c.config.Timeout)
+	// Send the data and our coordinate to the target peer.
+	wbuf := append(rbuf[:c.config.PingBufferSize], c.coordinates.Coordinate().Encode()...)
+	err = util.WriteWithTimeout(stream, wbuf, c.config.Timeout)
 	if err != nil {
 		c.logger.Warning("Cannot send data to", pid, err)
 	}
 
 	// Update the routing table.
-	c.table.Update(pid)
+	c.update(pid)
 
 }
 
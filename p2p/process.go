@@ -18,11 +18,29 @@ import (
 	"gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
 
 	"github.com/dfinity/go-revolver/artifact"
+	"github.com/dfinity/go-revolver/routingtable"
 )
 
-// Process artifacts from a stream.
+// Every message on an artifact stream begins with one of these frame types, or
+// with an acknowledgement, which is followed by the response to a request, or
+// with a negative acknowledgement, which is followed by the error that
+// prevented the response.
+const (
+	stx = 0x02 // An artifact follows.
+	enq = 0x05 // A request follows.
+	syn = 0x16 // A heartbeat.
+)
+
+// Process artifacts from a paired stream.
 func (client *client) process(stream net.Stream) {
+	client.consume(stream)
+	client.streamstore.RemoveStream(stream.Conn().RemotePeer(), stream)
+}
 
+// Consume artifacts from a stream until it fails.
+func (client *client) consume(stream net.Stream) {
+
+	var frame [1]byte
 	var metadata [45]byte
 	var witnesses []peer.ID
 
@@ -31,8 +49,39 @@ func (client *client) process(stream net.Stream) {
 Processing:
 	for {
 
+		// Read the frame type.
+		_, err := io.ReadFull(stream, frame[:])
+		if err != nil {
+			if isProbableEOF(err) {
+				client.logger.Debug("Disconnecting from", pid)
+			} else {
+				client.logger.Warning("Cannot get frame type from", pid, err)
+			}
+			break Processing
+		}
+		client.streamstore.Touch(pid)
+		switch frame[0] {
+		case stx:
+		case syn:
+			continue Processing
+		case enq, ack, nak:
+			err = client.streamstore.Serve(pid, frame[0], stream)
+			if err != nil {
+				if isProbableEOF(err) {
+					client.logger.Debug("Disconnecting from", pid)
+				} else {
+					client.logger.Warning("Cannot serve request from", pid, err)
+				}
+				break Processing
+			}
+			continue Processing
+		default:
+			client.logger.Warningf("Cannot recognize frame type %#x from %v", frame[0], pid)
+			break Processing
+		}
+
 		// Read the artifact metadata.
-		_, err := io.ReadFull(stream, metadata[:])
+		_, err = io.ReadFull(stream, metadata[:])
 		if err != nil {
 			if isProbableEOF(err) {
 				client.logger.Debug("Disconnecting from", pid)
@@ -43,6 +92,17 @@ Processing:
 		}
 		checksum, compression, size, timestamp := artifact.DecodeMetadata(metadata)
 
+		// Read the artifact route.
+		hops, hopLimit, path, err := artifact.DecodeRoute(stream)
+		if err != nil {
+			if isProbableEOF(err) {
+				client.logger.Debug("Disconnecting from", pid)
+			} else {
+				client.logger.Warning("Cannot get artifact route from", pid, err)
+			}
+			break Processing
+		}
+
 		// Log the artifact metadata.
 		code := hex.EncodeToString(checksum[:4])
 		latency := time.Since(timestamp)
@@ -51,13 +111,36 @@ Processing:
 		// Check if the client can buffer the artifact.
 		if size > client.config.ArtifactMaxBufferSize {
 			client.logger.Warningf("Cannot accept %d byte artifact with checksum %s from %v", size, code, pid)
+			client.streamstore.Observe(pid, routingtable.Invalid)
 			break Processing
 		}
 
+		// Check if the artifact has travelled too far.
+		if int(hops) > client.config.ArtifactMaxHops {
+			client.logger.Warningf("Cannot accept artifact with checksum %s from %v after %d hops", code, pid, hops)
+			client.streamstore.Observe(pid, routingtable.Invalid)
+			_, err = io.CopyN(ioutil.Discard, stream, int64(size))
+			if err != nil {
+				if isProbableEOF(err) {
+					client.logger.Debug("Disconnecting from", pid)
+				} else {
+					client.logger.Warning("Cannot read artifact from", pid, err)
+				}
+				break Processing
+			}
+			continue Processing
+		}
+
+		// Enforce the maximum hop limit.
+		if int(hops)+int(hopLimit) > client.config.ArtifactMaxHops {
+			hopLimit = uint8(client.config.ArtifactMaxHops - int(hops))
+		}
+
 		// Check if the client has already received the artifact.
 		client.artifactCacheLock.Lock()
 		if client.artifactCache.Contains(checksum) {
 			client.artifactCacheLock.Unlock()
+			client.streamstore.Observe(pid, routingtable.Stale)
 			_, err = io.CopyN(ioutil.Discard, stream, int64(size))
 			if err != nil {
 				if isProbableEOF(err) {
@@ -71,8 +154,9 @@ Processing:
 		}
 
 		// Update the artifact cache.
-		client.artifactCache.Add(checksum, size)
+		client.artifactCache.Add(checksum, artifactRoute{hops, hopLimit, path})
 		client.artifactCacheLock.Unlock()
+		client.streamstore.Observe(pid, routingtable.Fresh)
 
 		// Update the witnesses of the artifact.
 		client.witnessCacheLock.Lock()
@@ -84,19 +168,18 @@ Processing:
 		client.witnessCacheLock.Unlock()
 
 		// Queue the artifact.
-		object := artifact.New(stream, checksum, compression, size, timestamp)
+		object := artifact.NewWithRoute(stream, checksum, compression, size, timestamp, hops, hopLimit, path)
 		client.receive <- object
 
 		// Check if the artifact was invalid.
 		if object.Wait() != 0 {
+			client.streamstore.Observe(pid, routingtable.Invalid)
 			client.logger.Debug("Disconnecting from", pid)
 			break Processing
 		}
 
 	}
 
-	client.streamstore.Remove(pid)
-
 }
 
 // Check if an error resembles a connection termination scenario that would
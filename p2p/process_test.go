@@ -113,7 +113,7 @@ func TestDuplication(test *testing.T) {
 			case <-notify2:
 				return
 			case artifact := <-client2.receive:
-				client2.send <- artifact
+				client2.Send(artifact)
 			}
 		}
 	}()
@@ -125,7 +125,7 @@ func TestDuplication(test *testing.T) {
 			case <-notify4:
 				return
 			case artifact := <-client4.receive:
-				client4.send <- artifact
+				client4.Send(artifact)
 			}
 		}
 	}()
@@ -139,7 +139,7 @@ func TestDuplication(test *testing.T) {
 			if err != nil {
 				test.Fatal(err)
 			}
-			client1.send <- artifactOut
+			client1.Send(artifactOut)
 		}
 	}()
 
@@ -0,0 +1,127 @@
+/**
+ * File        : receipt.go
+ * Description : Artifact delivery receipts.
+ * Copyright   : Copyright (c) 2017-2018 DFINITY Stiftung. All rights reserved.
+ * Maintainer  : Enzo Haussecker <enzo@dfinity.org>
+ * Stability   : Experimental
+ */
+
+package p2p
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
+)
+
+// Receipt -- This type records the delivery of an artifact to peers. It is
+// safe to inspect a receipt while the transfer is still in progress.
+type Receipt struct {
+	checksum  [32]byte
+	delivered []string
+	done      chan struct{}
+	elapsed   map[string]time.Duration
+	failed    map[string]error
+	finished  time.Time
+	lock      *sync.Mutex
+	started   time.Time
+}
+
+// Create a receipt for an artifact.
+func newReceipt(checksum [32]byte) *Receipt {
+	return &Receipt{
+		checksum: checksum,
+		done:     make(chan struct{}),
+		elapsed:  make(map[string]time.Duration),
+		failed:   make(map[string]error),
+		lock:     &sync.Mutex{},
+		started:  time.Now(),
+	}
+}
+
+// Checksum -- Get the checksum of the artifact.
+func (receipt *Receipt) Checksum() [32]byte {
+	return receipt.checksum
+}
+
+// Delivered -- List the peers that received the full artifact.
+func (receipt *Receipt) Delivered() []string {
+	receipt.lock.Lock()
+	defer receipt.lock.Unlock()
+	result := make([]string, len(receipt.delivered))
+	copy(result, receipt.delivered)
+	return result
+}
+
+// Elapsed -- Get the time from the start of the transfer until each peer
+// received the full artifact or failed to.
+func (receipt *Receipt) Elapsed() map[string]time.Duration {
+	receipt.lock.Lock()
+	defer receipt.lock.Unlock()
+	result := make(map[string]time.Duration, len(receipt.elapsed))
+	for id, elapsed := range receipt.elapsed {
+		result[id] = elapsed
+	}
+	return result
+}
+
+// Failed -- List the peers that failed to receive the artifact and why.
+func (receipt *Receipt) Failed() map[string]error {
+	receipt.lock.Lock()
+	defer receipt.lock.Unlock()
+	result := make(map[string]error, len(receipt.failed))
+	for id, err := range receipt.failed {
+		result[id] = err
+	}
+	return result
+}
+
+// Finished -- Get the time at which the transfer finished. This is the zero
+// time if the transfer is still in progress.
+func (receipt *Receipt) Finished() time.Time {
+	receipt.lock.Lock()
+	defer receipt.lock.Unlock()
+	return receipt.finished
+}
+
+// Wait -- Wait for the transfer to finish. An error is returned if the context
+// expires first.
+func (receipt *Receipt) Wait(ctx context.Context) error {
+	select {
+	case <-receipt.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Record that a peer received the full artifact.
+func (receipt *Receipt) deliver(pid peer.ID) {
+	receipt.lock.Lock()
+	defer receipt.lock.Unlock()
+	receipt.delivered = append(receipt.delivered, pid.Pretty())
+	receipt.elapsed[pid.Pretty()] = time.Since(receipt.started)
+}
+
+// Record that a peer failed to receive the artifact.
+func (receipt *Receipt) fail(pid peer.ID, err error) {
+	receipt.failID(pid.Pretty(), err)
+}
+
+// Record that a peer with the given identifier failed to receive the artifact.
+func (receipt *Receipt) failID(id string, err error) {
+	receipt.lock.Lock()
+	defer receipt.lock.Unlock()
+	receipt.failed[id] = err
+	receipt.elapsed[id] = time.Since(receipt.started)
+}
+
+// Mark the transfer as finished.
+func (receipt *Receipt) finish() {
+	receipt.lock.Lock()
+	defer receipt.lock.Unlock()
+	receipt.finished = time.Now()
+	close(receipt.done)
+}
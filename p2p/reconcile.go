@@ -0,0 +1,316 @@
+/**
+ * File        : reconcile.go
+ * Description : Service for reconciling recently seen artifacts.
+ * Copyright   : Copyright (c) 2017-2018 DFINITY Stiftung. All rights reserved.
+ * Maintainer  : Enzo Haussecker <enzo@dfinity.org>
+ * Stability   : Experimental
+ */
+
+package p2p
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"gx/ipfs/QmNa31VPzC561NWwRsJLE7nGYZYuuD2QfpK2b1q9BK54J1/go-libp2p-net"
+	"gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
+
+	"github.com/dfinity/go-revolver/util"
+)
+
+// Periodically reconcile recently seen artifacts with a random paired peer.
+func (client *client) activateReconciliation() func() {
+
+	// Create a shutdown function.
+	notify := make(chan struct{})
+	shutdown := func() {
+		close(notify)
+	}
+
+	// Reconcile with paired peers.
+	go func() {
+		for {
+			select {
+			case <-notify:
+				return
+			case <-time.After(client.config.ReconcileInterval):
+				peers := append(
+					client.streamstore.InboundPeers(),
+					client.streamstore.OutboundPeers()...,
+				)
+				if len(peers) > 0 {
+					client.reconcile(peers[rand.Intn(len(peers))])
+				}
+			}
+		}
+	}()
+
+	// Return the shutdown function.
+	return shutdown
+
+}
+
+// Request to reconcile recently seen artifacts with a peer.
+func (client *client) reconcile(peerId peer.ID) error {
+
+	// Log this action.
+	pid := peerId
+	client.logger.Debug("Requesting to reconcile artifacts with", pid)
+
+	// Connect to the target peer.
+	stream, err := client.host.NewStream(
+		client.context,
+		pid,
+		client.protocol+"/reconcile",
+	)
+	if err != nil {
+		client.logger.Debug("Cannot connect to", pid, err)
+		return err
+	}
+	defer stream.Close()
+
+	// Exchange summaries with the target peer.
+	checksums := client.recentChecksums()
+	err = client.sendSummary(stream, summarize(checksums))
+	if err != nil {
+		return err
+	}
+	filter, err := client.receiveSummary(stream)
+	if err != nil {
+		return err
+	}
+
+	// Send the target peer whatever it is missing.
+	client.push(pid, checksums, filter)
+
+	// Success.
+	return nil
+
+}
+
+// Handle incomming requests for reconciliation.
+func (client *client) reconcileHandler(stream net.Stream) {
+
+	defer stream.Close()
+
+	// Log this action.
+	pid := stream.Conn().RemotePeer()
+	client.logger.Debug("Receiving request to reconcile artifacts with", pid)
+
+	// Only reconcile with paired peers.
+	if !client.paired(pid) {
+		client.logger.Debug("Cannot reconcile artifacts with unpaired peer", pid)
+		return
+	}
+
+	// Exchange summaries with the target peer.
+	filter, err := client.receiveSummary(stream)
+	if err != nil {
+		return
+	}
+	checksums := client.recentChecksums()
+	err = client.sendSummary(stream, summarize(checksums))
+	if err != nil {
+		return
+	}
+
+	// Send the target peer whatever it is missing.
+	client.push(pid, checksums, filter)
+
+}
+
+// Register the reconciliation handler.
+func (client *client) registerReconcileService() {
+	uri := client.protocol + "/reconcile"
+	client.host.SetStreamHandler(uri, client.reconcileHandler)
+}
+
+// Check if a peer is paired with the client.
+func (client *client) paired(pid peer.ID) bool {
+	peers := append(
+		client.streamstore.InboundPeers(),
+		client.streamstore.OutboundPeers()...,
+	)
+	for i := range peers {
+		if peers[i] == pid {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the checksums of the most recently seen artifacts.
+func (client *client) recentChecksums() [][32]byte {
+
+	client.artifactCacheLock.Lock()
+	keys := client.artifactCache.Keys()
+	client.artifactCacheLock.Unlock()
+
+	// The keys are ordered from oldest to newest.
+	if len(keys) > client.config.ReconcileWindow {
+		keys = keys[len(keys)-client.config.ReconcileWindow:]
+	}
+
+	checksums := make([][32]byte, len(keys))
+	for i := range keys {
+		checksums[i] = keys[i].([32]byte)
+	}
+
+	return checksums
+
+}
+
+// Summarize a set of checksums.
+func summarize(checksums [][32]byte) *bloomFilter {
+	filter := newBloomFilter(len(checksums))
+	for i := range checksums {
+		filter.add(checksums[i])
+	}
+	return filter
+}
+
+// Send a summary.
+func (client *client) sendSummary(stream net.Stream, filter *bloomFilter) error {
+
+	data := filter.encode()
+	size := util.EncodeBigEndianUInt32(uint32(len(data)))
+
+	err := util.WriteWithTimeout(
+		stream,
+		append(size[:], data...),
+		client.config.Timeout,
+	)
+	if err != nil {
+		pid := stream.Conn().RemotePeer()
+		client.logger.Debug("cannot send summary to", pid, err)
+		return err
+	}
+
+	return nil
+
+}
+
+// Receive a summary.
+func (client *client) receiveSummary(stream net.Stream) (*bloomFilter, error) {
+
+	size, err := util.ReadUInt32WithTimeout(
+		stream,
+		client.config.Timeout,
+	)
+	if err != nil {
+		pid := stream.Conn().RemotePeer()
+		client.logger.Debug("cannot receive summary size from", pid, err)
+		return nil, err
+	}
+
+	if size > client.config.ReconcileMaxBufferSize {
+		pid := stream.Conn().RemotePeer()
+		client.logger.Debugf("cannot accept %d byte summary from %v", size, pid)
+		return nil, errors.New("summary exceeds maximum buffer size")
+	}
+
+	data, err := util.ReadWithTimeout(
+		stream,
+		size,
+		client.config.Timeout,
+	)
+	if err != nil {
+		pid := stream.Conn().RemotePeer()
+		client.logger.Debug("cannot receive summary from", pid, err)
+		return nil, err
+	}
+
+	return decodeBloomFilter(data)
+
+}
+
+// Push the artifacts that a peer is missing over its paired stream. The
+// artifacts are obtained from the artifact request handler, which has one
+// timeout for the whole round, so that a slow or missing handler cannot stall
+// reconciliation. Whatever is left is pushed in the next round.
+func (client *client) push(pid peer.ID, checksums [][32]byte, filter *bloomFilter) {
+
+	deadline := time.Now().Add(client.config.Timeout)
+
+	for _, checksum := range checksums {
+
+		// Stop once the round is over.
+		if time.Now().After(deadline) {
+			client.logger.Debug("Deferring reconciliation with", pid, "to the next round")
+			return
+		}
+
+		// Skip the artifact if the peer has it or sent it to us.
+		if filter.contains(checksum) || client.witnessed(checksum, pid) {
+			continue
+		}
+
+		// Get the route by which the artifact reached the client.
+		client.artifactCacheLock.Lock()
+		route, exists := client.artifactCache.Peek(checksum)
+		client.artifactCacheLock.Unlock()
+		if !exists {
+			continue
+		}
+
+		// Get the artifact from the artifact request handler.
+		object := client.requestArtifact(checksum, deadline)
+		if object == nil {
+			continue
+		}
+
+		// Restore the route of the artifact, so that reconciliation neither
+		// extends its hop limit nor loses its path.
+		object = &routed{object, route.(artifactRoute)}
+
+		// Encode the artifact header if the artifact may travel any further.
+		header, ok := client.header(object)
+		if !ok {
+			object.Close()
+			continue
+		}
+
+		// Send the artifact to the peer.
+		s := client.newShipment(client.lane(object.Size()), header, client.chunks(object.Size()))
+		results := s.lane.applyTo(client.writeShipment(s), peer.IDSlice{pid})
+		err := client.fill(object, s.buffer)
+		if err != nil {
+			client.logger.Warning("Cannot read artifact", err)
+			object.Disconnect()
+		} else {
+			object.Close()
+		}
+
+		// Stop if the peer is no longer paired or failed to receive it.
+		result, exists := results[pid]
+		if !exists {
+			return
+		}
+		err = <-result
+		if err != nil {
+			client.logger.Debug(pid, "failed to receive the artifact", err)
+			if s.begun(pid) {
+				client.streamstore.Remove(pid)
+			}
+			return
+		}
+
+	}
+
+}
+
+// Check if a peer sent us an artifact.
+func (client *client) witnessed(checksum [32]byte, pid peer.ID) bool {
+	client.witnessCacheLock.Lock()
+	defer client.witnessCacheLock.Unlock()
+	witnesses, exists := client.witnessCache.Get(checksum)
+	if exists {
+		for _, id := range witnesses.([]peer.ID) {
+			if id == pid {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+/**
+ * File        : reconcile_test.go
+ * Description : Unit tests.
+ * Copyright   : Copyright (c) 2017-2018 DFINITY Stiftung. All rights reserved.
+ * Maintainer  : Enzo Haussecker <enzo@dfinity.org>
+ * Stability   : Experimental
+ */
+
+package p2p
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"gx/ipfs/QmPgDWmTmuzvP7QE5zwo1TmjbJme9pmZHNujB2453jkCTr/go-libp2p-peerstore"
+
+	"github.com/dfinity/go-revolver/artifact"
+	"github.com/enzoh/go-logging"
+	"github.com/hashicorp/golang-lru"
+)
+
+// Show that a client can recover an artifact that it missed from a peer.
+func TestReconcile(test *testing.T) {
+
+	// Create a client.
+	client1, shutdown1 := newTestClient(test)
+	defer shutdown1()
+
+	// Create a second client.
+	client2, shutdown2 := newTestClient(test)
+	defer shutdown2()
+
+	// Add the second client to the peer store of the first.
+	client1.peerstore.AddAddrs(
+		client2.id,
+		client2.host.Addrs(),
+		peerstore.ProviderAddrTTL,
+	)
+
+	// Pair the first and second client.
+	success, err := client1.pair(client2.id)
+	if err != nil || !success {
+		test.Fatal(err)
+	}
+
+	// Let the first client see an artifact that the second client missed.
+	dataOut := []byte("This is a test.")
+	artifactOut, err := artifact.FromBytes(dataOut, false)
+	if err != nil {
+		test.Fatal(err)
+	}
+	client1.artifactCache.Add(artifactOut.Checksum(), routeOf(artifactOut))
+
+	// Provide the artifact on request.
+	client1.SetArtifactHandler(func(checksum [32]byte, response chan artifact.Artifact) {
+		object, _ := artifact.FromBytes(dataOut, false)
+		response <- object
+	})
+
+	// Reconcile the first and second client.
+	err = client1.reconcile(client2.id)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	select {
+
+	// Wait for the second client to receive the artifact.
+	case artifactIn := <-client2.receive:
+
+		// Create a byte slice from the artifact.
+		dataIn, err := artifact.ToBytes(artifactIn)
+		if err != nil {
+			test.Fatal(err)
+		}
+
+		// Verify that the data sent and received is the same.
+		if !bytes.Equal(dataOut, dataIn) {
+			test.Fatal("Corrupt artifact!")
+		}
+
+	case <-time.After(time.Second):
+		test.Fatal("Missing artifact!")
+
+	}
+
+}
+
+// Show that a round of reconciliation ends in time when no artifact request
+// handler answers.
+func TestPushDeadline(test *testing.T) {
+
+	client := &client{
+		artifactCacheLock: &sync.Mutex{},
+		artifactRequests:  make(chan artifactRequest, 16),
+		config:            DefaultConfig(),
+		logger:            logging.MustGetLogger("p2p"),
+		witnessCacheLock:  &sync.Mutex{},
+	}
+	client.config.Timeout = 50 * time.Millisecond
+	var err error
+	client.artifactCache, err = lru.New(16)
+	if err != nil {
+		test.Fatal(err)
+	}
+	client.witnessCache, err = lru.New(16)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	// Let the client see artifacts that the peer is missing.
+	var checksums [][32]byte
+	for i := 0; i < 8; i++ {
+		object, err := artifact.FromBytes([]byte{byte(i)}, false)
+		if err != nil {
+			test.Fatal(err)
+		}
+		client.artifactCache.Add(object.Checksum(), routeOf(object))
+		checksums = append(checksums, object.Checksum())
+	}
+
+	// Verify that the round takes a single timeout, not one per artifact.
+	start := time.Now()
+	client.push("peer", checksums, newBloomFilter(0))
+	if elapsed := time.Since(start); elapsed > 4*client.config.Timeout {
+		test.Fatal("Reconciliation took too long!", elapsed)
+	}
+	if len(client.artifactRequests) != 1 {
+		test.Fatal("Expected a single pending request!", len(client.artifactRequests))
+	}
+
+}
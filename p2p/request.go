@@ -0,0 +1,86 @@
+/**
+ * File        : request.go
+ * Description : Service for answering requests over paired streams.
+ * Copyright   : Copyright (c) 2017-2018 DFINITY Stiftung. All rights reserved.
+ * Maintainer  : Enzo Haussecker <enzo@dfinity.org>
+ * Stability   : Experimental
+ */
+
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"time"
+
+	"gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
+
+	"github.com/dfinity/go-revolver/streamstore"
+)
+
+// Every request on a paired stream begins with one of these methods.
+const (
+	echo = 0x00 // Return the rest of the request.
+)
+
+// Answer a request from a paired peer.
+func (client *client) answer(pid peer.ID, request []byte) ([]byte, error) {
+
+	if len(request) == 0 {
+		return nil, errors.New("Empty request")
+	}
+
+	switch request[0] {
+	case echo:
+		return request[1:], nil
+	default:
+		return nil, fmt.Errorf("Unknown method %#x", request[0])
+	}
+
+}
+
+// Measure the latency of a peer over its paired stream, or over a temporary
+// stream if the peer is not paired.
+func (client *client) probeStreamLatency(pid peer.ID) (zero time.Duration, err error) {
+
+	// Generate random data.
+	request := make([]byte, 1+client.config.PingBufferSize)
+	request[0] = echo
+	_, err = rand.Reader.Read(request[1:])
+	if err != nil {
+		client.logger.Warning("Cannot generate random data", err)
+		return zero, err
+	}
+
+	// Observe the current time.
+	before := time.Now()
+
+	// Exchange data with the target peer.
+	ctx, cancel := context.WithTimeout(client.context, client.config.Timeout)
+	defer cancel()
+	response, err := client.streamstore.Request(ctx, pid, request)
+	if err == streamstore.ErrNotPaired {
+		return client.probeLatency(pid)
+	}
+	if err != nil {
+		client.logger.Debug("Cannot exchange data with", pid, err)
+		return zero, err
+	}
+
+	// Verify that the data sent and received is the same.
+	if !bytes.Equal(request[1:], response) {
+		err = errors.New("Corrupt data!")
+		client.logger.Warning("Cannot verify data received from", pid, err)
+		return zero, err
+	}
+
+	// Update our coordinate.
+	latency := time.Since(before)
+	client.coordinates.Update(pid, latency)
+
+	return latency, nil
+
+}
@@ -17,8 +17,17 @@ import (
 	"gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
 
 	"github.com/dfinity/go-revolver/util"
+	"github.com/dfinity/go-revolver/vivaldi"
 )
 
+// This type represents a random sample of peers along with the coordinates of
+// the sender and, where known, of the peers.
+type sampleResponse struct {
+	Coordinate  vivaldi.Coordinate
+	Peers       []peerstore.PeerInfo
+	Coordinates map[string]vivaldi.Coordinate
+}
+
 // Get a random sample of peers from the routing table of a peer.
 func (client *client) sample(peerId peer.ID) ([]peerstore.PeerInfo, error) {
 
@@ -69,15 +78,24 @@ func (client *client) sample(peerId peer.ID) ([]peerstore.PeerInfo, error) {
 	}
 
 	// Decode the data received from the target peer.
-	var sample []peerstore.PeerInfo
-	err = json.Unmarshal(data, &sample)
+	var response sampleResponse
+	err = json.Unmarshal(data, &response)
 	if err != nil {
 		client.logger.Warning("Cannot decode data received from", pid, err)
 		return nil, err
 	}
 
+	// Record the coordinates.
+	client.coordinates.Observe(pid, response.Coordinate)
+	for _, info := range response.Peers {
+		coord, exists := response.Coordinates[info.ID.Pretty()]
+		if exists && info.ID != client.id {
+			client.coordinates.ObserveRelayed(info.ID, coord)
+		}
+	}
+
 	// Success.
-	return sample, nil
+	return response.Peers, nil
 
 }
 
@@ -105,8 +123,21 @@ func (client *client) sampleHandler(stream net.Stream) {
 		peers = append(peers[:j], peers[j+1:]...)
 	}
 
+	// Add the coordinates.
+	response := sampleResponse{
+		Coordinate:  client.coordinates.Coordinate(),
+		Peers:       sample,
+		Coordinates: make(map[string]vivaldi.Coordinate),
+	}
+	for _, info := range sample {
+		coord, exists := client.coordinates.Lookup(info.ID)
+		if exists {
+			response.Coordinates[info.ID.Pretty()] = coord
+		}
+	}
+
 	// Encode the peer list.
-	data, err := json.Marshal(sample)
+	data, err := json.Marshal(response)
 	if err != nil {
 		client.logger.Warning("Cannot encode peers")
 		return
@@ -125,7 +156,7 @@ func (client *client) sampleHandler(stream net.Stream) {
 	}
 
 	// Update the routing table.
-	client.table.Update(pid)
+	client.update(pid)
 
 }
 
@@ -0,0 +1,133 @@
+package routingtable
+
+import (
+	"math/rand"
+	"time"
+
+	"gx/ipfs/QmPgDWmTmuzvP7QE5zwo1TmjbJme9pmZHNujB2453jkCTr/go-libp2p-peerstore"
+	"gx/ipfs/QmSAFA8v42u4gpJNy1tb7vW3JiiXiaYDC2b845c2RnNSJL/go-libp2p-kbucket"
+	"gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
+)
+
+// KademliaConfig configures a Kademlia routing table
+type KademliaConfig struct {
+	BucketSize       int
+	LatencyTolerance time.Duration
+	// The latency information that decides whether a peer is admitted.
+	Metrics peerstore.Metrics
+	// An optional source of randomness for recommendations, which makes them
+	// reproducible.  It need not be safe for concurrent use.
+	RandomSource rand.Source
+	// The weight that past observations of a peer keep with each new one, and
+	// the number of peers whose reputation is remembered.  Zero means 0.95
+	// and 1024.
+	ReputationDecay       float64
+	ReputationHistorySize int
+}
+
+// kademliaRoutingTable is a RoutingTable based on XOR distance buckets.
+type kademliaRoutingTable struct {
+	table       *kbucket.RoutingTable
+	metrics     peerstore.Metrics
+	rand        *rand.Rand
+	reputations *reputations
+}
+
+// NewDefaultKademliaConfig creates a KademliaConfig with default parameters.
+func NewDefaultKademliaConfig(metrics peerstore.Metrics) KademliaConfig {
+	return KademliaConfig{
+		BucketSize:            16,
+		LatencyTolerance:      time.Minute,
+		Metrics:               metrics,
+		ReputationDecay:       0.95,
+		ReputationHistorySize: 1024,
+	}
+}
+
+// NewKademliaFactory creates a Factory for RoutingTables with the given
+// config.
+func NewKademliaFactory(conf KademliaConfig) Factory {
+	return func(self peer.ID, _ LatencyProbeFn) RoutingTable {
+		return NewKademliaRoutingTable(self, conf)
+	}
+}
+
+// NewKademliaRoutingTable creates a RoutingTable for the local peer with the
+// given config.
+func NewKademliaRoutingTable(self peer.ID, conf KademliaConfig) RoutingTable {
+	if conf.ReputationDecay <= 0 {
+		conf.ReputationDecay = 0.95
+	}
+	return &kademliaRoutingTable{
+		table: kbucket.NewRoutingTable(
+			conf.BucketSize,
+			kbucket.ConvertPeerID(self),
+			conf.LatencyTolerance,
+			conf.Metrics,
+		),
+		metrics:     conf.Metrics,
+		rand:        newRand(conf.RandomSource),
+		reputations: newReputations(conf.ReputationHistorySize, conf.ReputationDecay),
+	}
+}
+
+func (k *kademliaRoutingTable) Add(pid peer.ID) {
+	k.table.Update(pid)
+}
+
+func (k *kademliaRoutingTable) Remove(pid peer.ID) {
+	k.table.Remove(pid)
+}
+
+func (k *kademliaRoutingTable) Update(pid peer.ID) {
+	k.table.Update(pid)
+}
+
+func (k *kademliaRoutingTable) Find(pid peer.ID) bool {
+	return k.table.Find(pid) == pid
+}
+
+func (k *kademliaRoutingTable) ListPeers() []peer.ID {
+	return k.table.ListPeers()
+}
+
+// Recommend a random sample of peers, except those in the `excludeList`
+func (k *kademliaRoutingTable) Recommend(count int, excludeList []peer.ID) []peer.ID {
+	exclude := make(map[peer.ID]bool)
+	for _, pid := range excludeList {
+		exclude[pid] = true
+	}
+
+	var recommended []peer.ID
+	peers := k.table.ListPeers()
+	perm := k.rand.Perm(len(peers))
+	for i := 0; i < len(perm) && len(recommended) < count; i++ {
+		pid := peers[perm[i]]
+		if !exclude[pid] {
+			recommended = append(recommended, pid)
+		}
+	}
+	return recommended
+}
+
+// Observe records an event, which affects the score of a peer but not its
+// recommendation, since Kademlia recommends peers uniformly at random.
+func (k *kademliaRoutingTable) Observe(pid peer.ID, event Event) {
+	k.reputations.observe(pid, event)
+}
+
+// Score a peer by its reputation and its latency in the metrics.
+func (k *kademliaRoutingTable) Score(pid peer.ID) float64 {
+	if k.metrics != nil {
+		if latency := k.metrics.LatencyEWMA(pid); latency > 0 {
+			k.reputations.observeLatency(pid, latency)
+		}
+	}
+	return k.reputations.score(pid)
+}
+
+func (k *kademliaRoutingTable) Size() int {
+	return k.table.Size()
+}
+
+func (k *kademliaRoutingTable) Shutdown() {}
@@ -0,0 +1,41 @@
+package routingtable
+
+import (
+	"testing"
+
+	"gx/ipfs/QmPgDWmTmuzvP7QE5zwo1TmjbJme9pmZHNujB2453jkCTr/go-libp2p-peerstore"
+	"gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
+)
+
+// Test that the Kademlia routing table keeps track of its peers and respects
+// the exclude list.
+func TestKademlia(t *testing.T) {
+	pids := uniquePIDs(4)
+	table := NewKademliaRoutingTable(pids[0], NewDefaultKademliaConfig(peerstore.NewMetrics()))
+	defer table.Shutdown()
+
+	for _, pid := range pids[1:] {
+		table.Update(pid)
+	}
+	if table.Size() != 3 || len(table.ListPeers()) != 3 {
+		t.Fatalf("Expected 3 peers, got %v", table.ListPeers())
+	}
+	if !table.Find(pids[1]) {
+		t.Fatalf("Cannot find %v", pids[1])
+	}
+
+	recommended := table.Recommend(3, []peer.ID{pids[1]})
+	if len(recommended) != 2 {
+		t.Fatalf("Expected 2 recommendations, got %v", recommended)
+	}
+	for _, pid := range recommended {
+		if pid == pids[1] {
+			t.Fatalf("Recommended excluded peer %v", pid)
+		}
+	}
+
+	table.Remove(pids[1])
+	if table.Find(pids[1]) {
+		t.Fatalf("Found removed peer %v", pids[1])
+	}
+}
@@ -0,0 +1,212 @@
+package routingtable
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru"
+	"gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
+)
+
+// Event is an observation about the behaviour of a peer, which the routing
+// table and the stream store both score peers by.
+type Event int
+
+const (
+	// The peer received what we sent it.
+	Delivered Event = iota
+
+	// The peer did not receive what we sent it in time.
+	Timeout
+
+	// The peer was the first to send us an artifact.
+	Fresh
+
+	// The peer sent us an artifact that we already had.
+	Stale
+
+	// The peer sent us an invalid artifact.
+	Invalid
+)
+
+// reputation is the decayed history of a peer.  Older observations lose
+// weight with every new one, so a peer can recover from past mistakes and a
+// good peer that turns bad fades out.
+type reputation struct {
+	delivered float64
+	timeouts  float64
+	fresh     float64
+	stale     float64
+	invalid   float64
+
+	// The latency of the peer, or zero if unknown.
+	latency time.Duration
+}
+
+// Rate the behaviour of the peer between zero and one, where higher is better.
+// A peer without history gets a neutral rating.
+func (r *reputation) trust() float64 {
+	delivery := (r.delivered + 1) / (r.delivered + r.timeouts + 2)
+	freshness := (r.fresh + 1) / (r.fresh + r.stale + 2)
+	return delivery * freshness / (1 + r.invalid)
+}
+
+// Score the peer between zero and one, where higher is better, by its
+// behaviour and its latency.  A peer of unknown latency gets a neutral speed.
+func (r *reputation) score() float64 {
+	speed := 0.5
+	if r.latency > 0 {
+		speed = 1 / (1 + 10*r.latency.Seconds())
+	}
+	return r.trust() * speed
+}
+
+func (r *reputation) observe(event Event, decay float64) {
+	r.delivered *= decay
+	r.timeouts *= decay
+	r.fresh *= decay
+	r.stale *= decay
+	r.invalid *= decay
+	switch event {
+	case Delivered:
+		r.delivered++
+	case Timeout:
+		r.timeouts++
+	case Fresh:
+		r.fresh++
+	case Stale:
+		r.stale++
+	case Invalid:
+		r.invalid++
+	}
+}
+
+// reputations remembers the history of recent peers, including those that
+// are no longer in the routing table, so that rejoining does not reset it.
+type reputations struct {
+	sync.Mutex
+	decay   float64
+	history *lru.Cache
+}
+
+func newReputations(size int, decay float64) *reputations {
+	if size <= 0 {
+		size = 1024
+	}
+	history, _ := lru.New(size)
+	return &reputations{decay: decay, history: history}
+}
+
+// Update the reputation of a peer.  The caller must hold the lock.
+func (rs *reputations) update(pid peer.ID, f func(*reputation)) {
+	r, exists := rs.history.Get(pid)
+	if !exists {
+		r = &reputation{}
+		rs.history.Add(pid, r)
+	}
+	f(r.(*reputation))
+}
+
+// Get the reputation of a peer.  The caller must hold the lock.
+func (rs *reputations) get(pid peer.ID) *reputation {
+	r, exists := rs.history.Peek(pid)
+	if !exists {
+		return &reputation{}
+	}
+	return r.(*reputation)
+}
+
+func (rs *reputations) observe(pid peer.ID, event Event) {
+	rs.Lock()
+	defer rs.Unlock()
+
+	rs.update(pid, func(r *reputation) {
+		r.observe(event, rs.decay)
+	})
+}
+
+func (rs *reputations) observeLatency(pid peer.ID, latency time.Duration) {
+	rs.Lock()
+	defer rs.Unlock()
+
+	rs.update(pid, func(r *reputation) {
+		r.latency = latency
+	})
+}
+
+func (rs *reputations) trust(pid peer.ID) float64 {
+	rs.Lock()
+	defer rs.Unlock()
+
+	return rs.get(pid).trust()
+}
+
+func (rs *reputations) score(pid peer.ID) float64 {
+	rs.Lock()
+	defer rs.Unlock()
+
+	return rs.get(pid).score()
+}
+
+// Choose `count` peers at random without replacement, where the chance of a
+// peer being chosen is proportional to its weight.
+func weightedSample(peers []peer.ID, count int, weight func(peer.ID) float64, random *rand.Rand) []peer.ID {
+	type candidate struct {
+		pid peer.ID
+		key float64
+	}
+
+	// The outcome only depends on the random source, not on the order of the
+	// peers.
+	peers = append([]peer.ID(nil), peers...)
+	sort.Sort(peer.IDSlice(peers))
+
+	// Each peer draws a key u^(1/w) and those with the largest keys win.
+	candidates := make([]candidate, 0, len(peers))
+	for _, pid := range peers {
+		w := weight(pid)
+		if w <= 0 {
+			continue
+		}
+		candidates = append(candidates, candidate{pid, math.Pow(random.Float64(), 1/w)})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].key > candidates[j].key
+	})
+
+	var sample []peer.ID
+	for i := 0; i < count && i < len(candidates); i++ {
+		sample = append(sample, candidates[i].pid)
+	}
+	return sample
+}
+
+// lockedSource makes a source of randomness safe for concurrent use.
+type lockedSource struct {
+	sync.Mutex
+	source rand.Source
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.source.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.Lock()
+	defer s.Unlock()
+	s.source.Seed(seed)
+}
+
+// Create a random number generator that is safe for concurrent use from the
+// given source, or from a source seeded with the current time if nil.
+func newRand(source rand.Source) *rand.Rand {
+	if source == nil {
+		source = rand.NewSource(time.Now().UnixNano())
+	}
+	return rand.New(&lockedSource{source: source})
+}
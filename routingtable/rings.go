@@ -2,27 +2,124 @@ package routingtable
 
 import (
 	"math/rand"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/enzoh/go-logging"
-	"gx/ipfs/QmPgDWmTmuzvP7QE5zwo1TmjbJme9pmZHNujB2453jkCTr/go-libp2p-peerstore"
 	"gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
 )
 
 // LatencyProbeFn is a function that accepts a peer ID and returns a latency.
 type LatencyProbeFn func(peer.ID) (time.Duration, error)
 
+// LatencyEstimateFn is a function that accepts a peer ID and returns an
+// estimated latency, if any, without contacting the peer.
+type LatencyEstimateFn func(peer.ID) (time.Duration, bool)
+
+// The weight of a new latency measurement in the moving average, as in the
+// peer store.
+const latencySmoothing = 0.1
+
+// RingsRoutingTable is a RoutingTable based on latency rings.
+type RingsRoutingTable interface {
+	RoutingTable
+
+	// Stats returns the occupancy of the rings.
+	Stats() RingsStats
+
+	// Rings returns the latency range and members of each ring.
+	Rings() []RingInfo
+
+	// OnEvict sets a function that is called, in its own goroutine, with each
+	// peer that the table evicts or demotes to the replacement cache, so that
+	// the caller can release its streams.
+	OnEvict(func(peer.ID))
+}
+
+// RingInfo describes a ring.  Its members have a latency in the range
+// (MinLatency, MaxLatency], where a zero MaxLatency means that the range is
+// unbounded.
+type RingInfo struct {
+	MinLatency time.Duration
+	MaxLatency time.Duration
+	Members    []RingMember
+	// The average latency of the members, or zero if there are none.
+	Latency time.Duration
+}
+
+// RingMember describes a peer in a ring.
+type RingMember struct {
+	ID peer.ID
+	// The moving average of the latency of the peer.
+	Latency time.Duration
+	// Whether the latency is only estimated.
+	Estimated bool
+}
+
+// RingsStats describes how peers are placed in the rings.
+type RingsStats struct {
+	// The number of peers in each ring.
+	Occupancy []int
+	// The number of peers whose latency is not yet known.
+	Unplaced int
+	// The number of peers whose latency is only estimated.
+	Estimated int
+	// The number of times a peer moved from one ring to another.
+	Moves int
+	// The number of candidates waiting for room in a ring.
+	Replacements int
+	// The number of peers evicted for being unresponsive.
+	Evictions int
+}
+
 // RingsConfig configures a Ring-based routing table
 type RingsConfig struct {
 	RingsCount          int
 	BaseLatency         time.Duration
 	LatencyGrowthFactor float64
-	SampleSize          int
-	SamplePeriod        time.Duration
+	// Every sample period, the latency of a random sample of peers is
+	// refreshed and the rings are re-balanced.
+	SampleSize   int
+	SamplePeriod time.Duration
+	// A peer only leaves its ring when its latency is outside the range of
+	// the ring by more than this fraction, so that it does not flap between
+	// neighbouring rings.
+	Hysteresis float64
 	// A function for retrieving the up-to-date latency information for a given
 	// peer.
 	LatencyProbFn LatencyProbeFn
+	// An optional function for estimating the latency of a peer, which places
+	// a new peer in a ring before its first latency probe completes.  It must
+	// not block.
+	LatencyEstimateFn LatencyEstimateFn
+	// The number of peers that may wait for their first latency probe, and
+	// the number of probes that may run at once.  Zero means 1024 and 4.
+	ProbeQueueSize int
+	ProbeWorkers   int
+	// Whether Add probes a new peer itself instead of in the background, and
+	// an optional source of the current time.  Together they let a simulation
+	// run the table deterministically on a virtual clock.  A nil clock means
+	// the wall clock.
+	SyncProbes bool
+	Clock      func() time.Time
+	// An optional source of randomness for recommendations, which makes them
+	// reproducible.  It need not be safe for concurrent use.
+	RandomSource rand.Source
+	// The weight that past observations of a peer keep with each new one, and
+	// the number of peers whose reputation is remembered.  Zero means 1024.
+	ReputationDecay       float64
+	ReputationHistorySize int
+	// A peer that has not been seen for the silence timeout is never
+	// recommended and is probed before others.  A peer whose probes or
+	// transactions fail this many times in a row is evicted.  Zero disables
+	// either.
+	SilenceTimeout time.Duration
+	MaxFailures    int
+	// The maximum number of peers in each ring, where zero means unlimited,
+	// and the number of candidates that wait for room in a full ring.
+	RingCapacity         int
+	ReplacementCacheSize int
 
 	Logger logging.Logger
 }
@@ -44,13 +141,49 @@ type ringsRoutingTable struct {
 	// latency range is [latRanges[n], latRanges[n+1]).
 	latRanges []time.Duration
 
-	// For storing latency info
-	metrics peerstore.Metrics
+	// For storing latency info, i.e. the moving average of each peer
+	metrics map[peer.ID]time.Duration
+
+	// Peers whose latency is only estimated
+	estimated map[peer.ID]bool
+
+	// The ring of each placed peer
+	placement map[peer.ID]int
+
+	// The number of times a peer moved between rings
+	moves int
+
+	// When each peer was last seen, and how many times in a row it failed
+	lastSeen map[peer.ID]time.Time
+	failures map[peer.ID]int
+
+	// Candidates for full rings, the most recently seen last
+	replacements []replacement
+
+	// The number of evicted peers, and a function to call with each
+	evictions int
+	onEvict   func(peer.ID)
+
+	// For storing reputation info
+	reputations *reputations
+
+	// For making recommendations
+	rand *rand.Rand
+
+	// Peers waiting for their first latency probe
+	probes chan peer.ID
 
 	// Shutdown signal
 	shutdown chan struct{}
 }
 
+// A replacement is a peer that waits for room in a full ring.
+type replacement struct {
+	pid      peer.ID
+	latency  time.Duration
+	lastSeen time.Time
+}
+
 // A ring stores a list of peers within a certain latency range
 type ring struct {
 	peers []peer.ID
@@ -71,35 +204,61 @@ func (r *ring) Remove(pid peer.ID) {
 }
 
 // Return `count` random peers in the ring, except for those in the `exclude`
-// list.
-func (r *ring) Recommend(count int, exclude map[peer.ID]bool) []peer.ID {
-	var recommended []peer.ID
-
-	perm := rand.Perm(len(r.peers))
-	for i := 0; i < count && i < len(perm); i++ {
-		pid := r.peers[perm[i]]
+// list.  Peers are chosen with a chance proportional to their weight.
+func (r *ring) Recommend(count int, exclude map[peer.ID]bool, weight func(peer.ID) float64, random *rand.Rand) []peer.ID {
+	var candidates []peer.ID
+	for _, pid := range r.peers {
 		if !exclude[pid] {
-			recommended = append(recommended, pid)
+			candidates = append(candidates, pid)
 		}
 	}
-
-	return recommended
+	return weightedSample(candidates, count, weight, random)
 }
 
 // NewDefaultRingsConfig creates a RingsConfig with default parameters.
 func NewDefaultRingsConfig(probe LatencyProbeFn) RingsConfig {
 	return RingsConfig{
-		RingsCount:          8,
-		BaseLatency:         8 * time.Millisecond,
-		LatencyGrowthFactor: 2,
-		SampleSize:          16,
-		SamplePeriod:        30 * time.Second,
-		LatencyProbFn:       probe,
+		RingsCount:           8,
+		BaseLatency:          8 * time.Millisecond,
+		LatencyGrowthFactor:  2,
+		SampleSize:           16,
+		SamplePeriod:         30 * time.Second,
+		Hysteresis:           0.1,
+		LatencyProbFn:        probe,
+		ProbeQueueSize:       1024,
+		ProbeWorkers:         4,
+		ReputationDecay:      0.95,
+		SilenceTimeout:       5 * time.Minute,
+		MaxFailures:          3,
+		RingCapacity:         32,
+		ReplacementCacheSize: 64,
+	}
+}
+
+// NewRingsFactory creates a Factory for RoutingTables with the given config.
+// The latency probe function of the config is replaced by that of the caller.
+func NewRingsFactory(conf RingsConfig) Factory {
+	return func(_ peer.ID, probe LatencyProbeFn) RoutingTable {
+		conf := conf
+		conf.LatencyProbFn = probe
+		return NewRingsRoutingTable(conf)
 	}
 }
 
 // NewRingsRoutingTable creates a RoutingTable with the given config.
-func NewRingsRoutingTable(conf RingsConfig) RoutingTable {
+func NewRingsRoutingTable(conf RingsConfig) RingsRoutingTable {
+	// Apply the default probe queue size and workers, so that Add never
+	// probes the peer itself.
+	if conf.ProbeQueueSize <= 0 {
+		conf.ProbeQueueSize = 1024
+	}
+	if conf.ProbeWorkers <= 0 {
+		conf.ProbeWorkers = 4
+	}
+	if conf.Clock == nil {
+		conf.Clock = time.Now
+	}
+
 	// Construct the latency ranges
 	// The first element is always going to be 0.
 	latRanges := []time.Duration{time.Duration(0)}
@@ -115,123 +274,458 @@ func NewRingsRoutingTable(conf RingsConfig) RoutingTable {
 	}
 
 	r := &ringsRoutingTable{
-		conf:      conf,
-		rings:     rings,
-		peers:     make(map[peer.ID]bool),
-		metrics:   peerstore.NewMetrics(),
-		latRanges: latRanges,
-		shutdown:  make(chan struct{}),
+		conf:        conf,
+		rings:       rings,
+		peers:       make(map[peer.ID]bool),
+		metrics:     make(map[peer.ID]time.Duration),
+		placement:   make(map[peer.ID]int),
+		estimated:   make(map[peer.ID]bool),
+		lastSeen:    make(map[peer.ID]time.Time),
+		failures:    make(map[peer.ID]int),
+		rand:        newRand(conf.RandomSource),
+		reputations: newReputations(conf.ReputationHistorySize, conf.ReputationDecay),
+		latRanges:   latRanges,
+		probes:      make(chan peer.ID, conf.ProbeQueueSize),
+		shutdown:    make(chan struct{}),
+	}
+
+	// Probe newly added peers until explicitly shut down, unless Add probes
+	// them itself.
+	for i := 0; i < r.conf.ProbeWorkers && !r.conf.SyncProbes; i++ {
+		go func() {
+			for {
+				select {
+				case pid := <-r.probes:
+					r.probe(pid)
+				case <-r.shutdown:
+					return
+				}
+			}
+		}()
 	}
 
 	// Periodically refresh latency and re-balance rings until explicitly shut
 	// down.
 	go func() {
-		select {
-		case <-time.After(r.conf.SamplePeriod):
-			r.refreshLatency()
-			r.populateRings()
-		case <-r.shutdown:
-			return
+		for {
+			select {
+			case <-time.After(r.conf.SamplePeriod):
+				r.refreshLatency()
+				r.rebalance()
+			case <-r.shutdown:
+				return
+			}
 		}
 	}()
 
 	return r
 }
 
-// refreshLatency picks a random subset of peers and refresh their latency
-// information.  The rings are then re-populated.
+// refreshLatency picks a subset of peers and refresh their latency
+// information.  Silent peers are picked first, the longest silent first, so
+// that unresponsive peers are evicted in time, and the rest of the subset is
+// random.
 func (r *ringsRoutingTable) refreshLatency() {
 	var pids []peer.ID
-	var peerCount int
+	var silent []peer.ID
 	func() {
 		r.RLock()
 		defer r.RUnlock()
 
-		// Get a list of all peers
+		// Get a list of all peers, in a stable order
 		for pid := range r.peers {
 			pids = append(pids, pid)
 		}
-		peerCount = len(pids)
+		sort.Sort(peer.IDSlice(pids))
+
+		// Get the silent peers
+		now := r.conf.Clock()
+		for _, pid := range pids {
+			if r.silent(pid, now) {
+				silent = append(silent, pid)
+			}
+		}
+		sort.SliceStable(silent, func(i, j int) bool {
+			return r.lastSeen[silent[i]].Before(r.lastSeen[silent[j]])
+		})
 	}()
 
-	// Get a random sample of the peers
+	// Get a sample of the peers
 	var sample []peer.ID
-	perm := rand.Perm(peerCount)
-	for i := 0; i < r.conf.SampleSize && i < peerCount; i++ {
-		sample = append(sample, pids[perm[i]])
+	picked := make(map[peer.ID]bool)
+	for _, pid := range silent {
+		if len(sample) == r.conf.SampleSize {
+			break
+		}
+		sample = append(sample, pid)
+		picked[pid] = true
+	}
+	for _, i := range r.rand.Perm(len(pids)) {
+		if len(sample) == r.conf.SampleSize {
+			break
+		}
+		if !picked[pids[i]] {
+			sample = append(sample, pids[i])
+		}
 	}
 
 	for _, pid := range sample {
 		latency, err := r.conf.LatencyProbFn(pid)
-		if err != nil {
-			r.conf.Logger.Errorf("error probing latency of peer %v", pid)
-		} else {
-			func() {
-				r.Lock()
-				defer r.Unlock()
-				r.metrics.RecordLatency(pid, latency)
-			}()
-		}
+		func() {
+			r.Lock()
+			defer r.Unlock()
+			// The peer may have been removed in the meantime.
+			if !r.peers[pid] {
+				return
+			}
+			if err != nil {
+				r.conf.Logger.Errorf("error probing latency of peer %v", pid)
+				r.fail(pid)
+				return
+			}
+			r.seen(pid)
+			r.recordLatency(pid, latency)
+		}()
 	}
 }
 
-// populateRings puts peers into the rings.
-func (r *ringsRoutingTable) populateRings() {
+// probe measures the latency of a newly added peer and places it into a ring.
+func (r *ringsRoutingTable) probe(pid peer.ID) {
+	latency, err := r.conf.LatencyProbFn(pid)
+
 	r.Lock()
 	defer r.Unlock()
 
-	var rings []*ring
-	for i := 0; i < r.conf.RingsCount; i++ {
-		rings = append(rings, &ring{})
+	// The peer may have been removed in the meantime.
+	if !r.peers[pid] {
+		return
 	}
 
-	for pid := range r.peers {
-		latency := r.metrics.LatencyEWMA(pid)
-		// Find the ring that the peer belongs to
-		for i := len(r.latRanges) - 1; i >= 0; i-- {
-			if latency > r.latRanges[i] {
-				rings[i].Add(pid)
-				break
-			}
-		}
+	if err != nil {
+		r.conf.Logger.Errorf("Error probing peer %s", pid)
+		r.fail(pid)
+		return
 	}
+	r.seen(pid)
+	r.recordLatency(pid, latency)
+	r.place(pid)
+}
 
-	r.rings = rings
+// seen records that a peer is alive.  The caller must hold the lock.
+func (r *ringsRoutingTable) seen(pid peer.ID) {
+	r.lastSeen[pid] = r.conf.Clock()
+	delete(r.failures, pid)
 }
 
-func (r *ringsRoutingTable) Add(pid peer.ID) {
-	// Do nothing if we already know about this peer.
-	if func() bool {
-		r.RLock()
-		defer r.RUnlock()
-		return r.peers[pid]
-	}() {
+// fail records that a peer did not respond, and evicts it if it failed too
+// many times in a row.  The caller must hold the lock.
+func (r *ringsRoutingTable) fail(pid peer.ID) {
+	r.failures[pid]++
+	if r.conf.MaxFailures > 0 && r.failures[pid] >= r.conf.MaxFailures {
+		r.conf.Logger.Debugf("Evicting unresponsive peer %s", pid)
+		r.evictions++
+		r.remove(pid)
+		r.evicted(pid)
+	}
+}
+
+// evicted lets the caller know that a peer left the table.  The caller must
+// hold the lock.
+func (r *ringsRoutingTable) evicted(pid peer.ID) {
+	if r.onEvict != nil {
+		go r.onEvict(pid)
+	}
+}
+
+// silent returns true if a peer has not been seen for longer than the silence
+// timeout.  The caller must hold the lock.
+func (r *ringsRoutingTable) silent(pid peer.ID, now time.Time) bool {
+	return r.conf.SilenceTimeout > 0 && now.Sub(r.lastSeen[pid]) > r.conf.SilenceTimeout
+}
+
+// remove forgets a peer and offers its place in a ring to a replacement.  The
+// caller must hold the lock.
+func (r *ringsRoutingTable) remove(pid peer.ID) {
+	delete(r.peers, pid)
+	i, placed := r.placement[pid]
+	if placed {
+		r.rings[i].Remove(pid)
+		delete(r.placement, pid)
+	}
+	delete(r.metrics, pid)
+	delete(r.estimated, pid)
+	delete(r.lastSeen, pid)
+	delete(r.failures, pid)
+	if placed {
+		r.promote(i)
+	}
+}
+
+// full returns true if the nth ring has no room.  The caller must hold the
+// lock.
+func (r *ringsRoutingTable) full(n int) bool {
+	return r.conf.RingCapacity > 0 && len(r.rings[n].peers) >= r.conf.RingCapacity
+}
+
+// demote moves a peer whose ring is full into the replacement cache.  The
+// caller must hold the lock.
+func (r *ringsRoutingTable) demote(pid peer.ID) {
+	candidate := replacement{pid, r.metrics[pid], r.lastSeen[pid]}
+	delete(r.peers, pid)
+	delete(r.metrics, pid)
+	delete(r.estimated, pid)
+	delete(r.lastSeen, pid)
+	delete(r.failures, pid)
+	r.evicted(pid)
+	if r.conf.ReplacementCacheSize <= 0 {
 		return
 	}
+	if len(r.replacements) >= r.conf.ReplacementCacheSize {
+		r.replacements = r.replacements[1:]
+	}
+	r.replacements = append(r.replacements, candidate)
+}
 
-	// Otherwise, ping it and record latency info.
-	// Note how we don't want to hold the lock while pinging it.
-	latency, err := r.conf.LatencyProbFn(pid)
-	if err != nil {
-		r.conf.Logger.Errorf("Error probing peer %s", pid)
+// promote moves the most recently seen replacement that belongs in the nth
+// ring into it.  The caller must hold the lock.
+func (r *ringsRoutingTable) promote(n int) {
+	for i := len(r.replacements) - 1; i >= 0; i-- {
+		candidate := r.replacements[i]
+		if r.ringIndex(candidate.latency) != n {
+			continue
+		}
+		r.replacements = append(r.replacements[:i], r.replacements[i+1:]...)
+		r.peers[candidate.pid] = true
+		r.metrics[candidate.pid] = candidate.latency
+		r.lastSeen[candidate.pid] = candidate.lastSeen
+		r.place(candidate.pid)
+		return
+	}
+}
+
+// replacementIndex returns the index of a peer in the replacement cache, or
+// -1 if it is not there.  The caller must hold the lock.
+func (r *ringsRoutingTable) replacementIndex(pid peer.ID) int {
+	for i, candidate := range r.replacements {
+		if candidate.pid == pid {
+			return i
+		}
+	}
+	return -1
+}
+
+// recordLatency updates the moving average of the latency of a peer.  The
+// caller must hold the lock.
+func (r *ringsRoutingTable) recordLatency(pid peer.ID, latency time.Duration) {
+	average, exists := r.metrics[pid]
+	if !exists || r.estimated[pid] {
+		delete(r.estimated, pid)
+		r.metrics[pid] = latency
+	} else {
+		r.metrics[pid] = time.Duration(latencySmoothing*float64(latency) + (1-latencySmoothing)*float64(average))
+	}
+	r.reputations.observeLatency(pid, r.metrics[pid])
+}
+
+// place moves a peer into the ring that matches its latency.  A peer that is
+// already in a ring stays there while its latency is within the range of the
+// ring, give or take the hysteresis, or while the matching ring is full.  A
+// probed peer whose ring is full becomes a replacement.  The caller must hold
+// the lock.
+func (r *ringsRoutingTable) place(pid peer.ID) {
+	latency, known := r.metrics[pid]
+	if !known {
+		return
+	}
+	current, placed := r.placement[pid]
+	if placed && r.within(current, latency) {
+		return
+	}
+	target := r.ringIndex(latency)
+	if placed && current == target {
 		return
 	}
+	if target >= 0 && r.full(target) {
+		if !placed && !r.estimated[pid] {
+			r.demote(pid)
+		}
+		return
+	}
+	if placed {
+		r.rings[current].Remove(pid)
+		delete(r.placement, pid)
+		r.moves++
+	}
+	if target >= 0 {
+		r.rings[target].Add(pid)
+		r.placement[pid] = target
+	}
+}
 
+// within returns true if the latency is within the range of the nth ring,
+// widened by the hysteresis.
+func (r *ringsRoutingTable) within(n int, latency time.Duration) bool {
+	lower := time.Duration(float64(r.latRanges[n]) * (1 - r.conf.Hysteresis))
+	if latency <= lower {
+		return false
+	}
+	if n+1 < len(r.latRanges) {
+		upper := time.Duration(float64(r.latRanges[n+1]) * (1 + r.conf.Hysteresis))
+		if latency > upper {
+			return false
+		}
+	}
+	return true
+}
+
+// ringIndex returns the index of the ring for the given latency, or -1 if the
+// latency is unknown.
+func (r *ringsRoutingTable) ringIndex(latency time.Duration) int {
+	for i := len(r.latRanges) - 1; i >= 0; i-- {
+		if latency > r.latRanges[i] {
+			return i
+		}
+	}
+	return -1
+}
+
+// rebalance moves peers whose latency has changed into their new rings.
+func (r *ringsRoutingTable) rebalance() {
 	r.Lock()
 	defer r.Unlock()
 
-	r.metrics.RecordLatency(pid, latency)
+	for pid := range r.peers {
+		r.place(pid)
+	}
+}
+
+func (r *ringsRoutingTable) Stats() RingsStats {
+	r.RLock()
+	defer r.RUnlock()
+
+	stats := RingsStats{
+		Occupancy:    make([]int, len(r.rings)),
+		Unplaced:     len(r.peers) - len(r.placement),
+		Estimated:    len(r.estimated),
+		Moves:        r.moves,
+		Replacements: len(r.replacements),
+		Evictions:    r.evictions,
+	}
+	for i, ring := range r.rings {
+		stats.Occupancy[i] = len(ring.peers)
+	}
+	return stats
+}
+
+func (r *ringsRoutingTable) Rings() []RingInfo {
+	r.RLock()
+	defer r.RUnlock()
+
+	infos := make([]RingInfo, len(r.rings))
+	for i, ring := range r.rings {
+		infos[i].MinLatency = r.latRanges[i]
+		if i+1 < len(r.latRanges) {
+			infos[i].MaxLatency = r.latRanges[i+1]
+		}
+		var total time.Duration
+		for _, pid := range ring.peers {
+			member := RingMember{
+				ID:        pid,
+				Latency:   r.metrics[pid],
+				Estimated: r.estimated[pid],
+			}
+			infos[i].Members = append(infos[i].Members, member)
+			total += member.Latency
+		}
+		if len(ring.peers) > 0 {
+			infos[i].Latency = total / time.Duration(len(ring.peers))
+		}
+	}
+	return infos
+}
+
+func (r *ringsRoutingTable) Add(pid peer.ID) {
+	if r.add(pid) && r.conf.SyncProbes {
+		r.probe(pid)
+	}
+}
+
+// add adds a peer and returns true if it is new.  Unless Add probes new peers
+// itself, the peer is queued to be probed in the background.
+func (r *ringsRoutingTable) add(pid peer.ID) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	// Do nothing if we already know about this peer.  A replacement is added
+	// again, since the caller holds its streams once more, and is probed anew
+	// in case there is room for it by now.
+	if r.peers[pid] {
+		return false
+	}
+	if i := r.replacementIndex(pid); i >= 0 {
+		r.replacements = append(r.replacements[:i], r.replacements[i+1:]...)
+	}
+
+	// Otherwise, add it with unknown latency and, unless probes are
+	// synchronous, probe it in the background so that the caller never waits
+	// on the network.  Until the probe completes, the peer is placed by its
+	// estimated latency, if any, or else is in no ring and is only
+	// recommended to make up for under-populated rings.
 	r.peers[pid] = true
+	r.lastSeen[pid] = r.conf.Clock()
+	if r.conf.LatencyEstimateFn != nil {
+		if latency, ok := r.conf.LatencyEstimateFn(pid); ok {
+			r.metrics[pid] = latency
+			r.estimated[pid] = true
+			r.place(pid)
+		}
+	}
+	if r.conf.SyncProbes {
+		return true
+	}
+	select {
+	case r.probes <- pid:
+	default:
+		r.conf.Logger.Warningf("Cannot queue latency probe for peer %s", pid)
+	}
+	return true
+}
+
+func (r *ringsRoutingTable) Update(pid peer.ID) {
+	r.Add(pid)
+
+	r.Lock()
+	defer r.Unlock()
+	if r.peers[pid] {
+		r.seen(pid)
+	}
+}
+
+func (r *ringsRoutingTable) Find(pid peer.ID) bool {
+	r.RLock()
+	defer r.RUnlock()
+	return r.peers[pid]
+}
+
+func (r *ringsRoutingTable) ListPeers() []peer.ID {
+	r.RLock()
+	defer r.RUnlock()
+	var peers []peer.ID
+	for pid := range r.peers {
+		peers = append(peers, pid)
+	}
+	return peers
 }
 
 func (r *ringsRoutingTable) Remove(pid peer.ID) {
 	r.Lock()
 	defer r.Unlock()
-	delete(r.peers, pid)
-	for _, ring := range r.rings {
-		ring.Remove(pid)
+	if i := r.replacementIndex(pid); i >= 0 {
+		r.replacements = append(r.replacements[:i], r.replacements[i+1:]...)
+	}
+	if r.peers[pid] {
+		r.remove(pid)
 	}
-	// TODO: remove the peer from the metrics store too
 }
 
 func (r *ringsRoutingTable) Recommend(count int, excludeList []peer.ID) []peer.ID {
@@ -244,6 +738,14 @@ func (r *ringsRoutingTable) Recommend(count int, excludeList []peer.ID) []peer.I
 		exclude[pid] = true
 	}
 
+	// Never recommend peers that have gone silent.
+	now := r.conf.Clock()
+	for pid := range r.peers {
+		if r.silent(pid, now) {
+			exclude[pid] = true
+		}
+	}
+
 	// Compute how many nodes we want from each ring
 	nodesFromRing := make([]int, r.conf.RingsCount)
 
@@ -261,9 +763,10 @@ func (r *ringsRoutingTable) Recommend(count int, excludeList []peer.ID) []peer.I
 		}
 	}
 
+	// Within each ring, prefer peers with a good reputation.
 	var recommended []peer.ID
 	for i, count := range nodesFromRing {
-		recommended = append(recommended, r.rings[i].Recommend(count, exclude)...)
+		recommended = append(recommended, r.rings[i].Recommend(count, exclude, r.reputations.trust, r.rand)...)
 	}
 
 	// It's possible that some rings are so under-populated that they are not
@@ -281,28 +784,50 @@ func (r *ringsRoutingTable) Recommend(count int, excludeList []peer.ID) []peer.I
 	return recommended
 }
 
-// Return a random sample of peers, except those in the `exclude` set
+// Return a random sample of peers weighted by reputation, except those in the
+// `exclude` set
 func (r *ringsRoutingTable) sample(count int, exclude map[peer.ID]bool) []peer.ID {
 	var peers []peer.ID
 	for pid := range r.peers {
-		peers = append(peers, pid)
-	}
-
-	var sample []peer.ID
-	perm := rand.Perm(len(peers))
-	for i := 0; i < count && i < len(perm); i++ {
-		pid := peers[perm[i]]
 		if !exclude[pid] {
-			sample = append(sample, pid)
+			peers = append(peers, pid)
 		}
 	}
-	return sample
+	return weightedSample(peers, count, r.reputations.trust, r.rand)
+}
+
+func (r *ringsRoutingTable) Score(pid peer.ID) float64 {
+	return r.reputations.score(pid)
+}
+
+func (r *ringsRoutingTable) Observe(pid peer.ID, event Event) {
+	r.reputations.observe(pid, event)
+
+	// Any sign of life but a timeout shows that the peer is alive.
+	r.Lock()
+	defer r.Unlock()
+	if !r.peers[pid] {
+		return
+	}
+	if event == Timeout {
+		r.fail(pid)
+	} else {
+		r.seen(pid)
+	}
 }
 
 func (r *ringsRoutingTable) Size() int {
+	r.RLock()
+	defer r.RUnlock()
 	return len(r.peers)
 }
 
+func (r *ringsRoutingTable) OnEvict(fn func(peer.ID)) {
+	r.Lock()
+	defer r.Unlock()
+	r.onEvict = fn
+}
+
 func (r *ringsRoutingTable) Shutdown() {
 	close(r.shutdown)
 }
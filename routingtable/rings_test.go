@@ -1,8 +1,10 @@
 package routingtable
 
 import (
+	"errors"
 	"math/rand"
 	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -94,3 +96,421 @@ func TestRecommendVaryingDistances(t *testing.T) {
 		t.Fatalf("Incorrect latency growth ratio: %v", averageRatio)
 	}
 }
+
+// Test that `Add` does not wait for the latency probe, and that the peer is
+// placed into a ring once the probe completes.
+func TestAddDoesNotBlock(t *testing.T) {
+	release := make(chan struct{})
+	config := NewDefaultRingsConfig(func(_ peer.ID) (time.Duration, error) {
+		<-release
+		return 256 * time.Millisecond, nil
+	})
+	table := NewRingsRoutingTable(config)
+	defer table.Shutdown()
+
+	pid := uniquePIDs(1)[0]
+	done := make(chan struct{})
+	go func() {
+		table.Add(pid)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Add is blocked by the latency probe")
+	}
+
+	// The peer can be recommended before its latency is known.
+	recommended := table.Recommend(1, nil)
+	if len(recommended) != 1 || recommended[0] != pid {
+		t.Fatalf("Expected to recommend %v, got %v", pid, recommended)
+	}
+
+	// The peer is placed into a ring once its latency is known.
+	close(release)
+	rings := table.(*ringsRoutingTable)
+	for i := 0; ; i++ {
+		rings.RLock()
+		placed := len(rings.rings[rings.ringIndex(256*time.Millisecond)].peers) == 1
+		rings.RUnlock()
+		if placed {
+			break
+		}
+		if i == 100 {
+			t.Fatal("Peer was not placed into a ring")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Test that peers with a good reputation are recommended more often than
+// peers with a bad one, and that bad peers are still recommended when needed.
+func TestRecommendByReputation(t *testing.T) {
+	table := NewRingsRoutingTable(NewDefaultRingsConfig(fixedLatencyProbe))
+	defer table.Shutdown()
+
+	pids := uniquePIDs(20)
+	good, bad := pids[:10], pids[10:]
+	for _, pid := range pids {
+		table.Add(pid)
+	}
+	for i := 0; i < 10; i++ {
+		for _, pid := range good {
+			table.Observe(pid, Delivered)
+			table.Observe(pid, Fresh)
+		}
+		for _, pid := range bad {
+			table.Observe(pid, Timeout)
+			table.Observe(pid, Invalid)
+		}
+	}
+
+	isGood := make(map[peer.ID]bool)
+	for _, pid := range good {
+		isGood[pid] = true
+	}
+	var goodCount, badCount int
+	for i := 0; i < 1000; i++ {
+		for _, pid := range table.Recommend(5, nil) {
+			if isGood[pid] {
+				goodCount++
+			} else {
+				badCount++
+			}
+		}
+	}
+	if goodCount < 4*badCount {
+		t.Fatalf("Good peers recommended %v times, bad peers %v times", goodCount, badCount)
+	}
+
+	// Without enough good peers, bad ones make up the difference.
+	if recommended := table.Recommend(20, nil); len(recommended) != 20 {
+		t.Fatalf("Expected 20 recommendations, got %v", len(recommended))
+	}
+}
+
+// Test that rebalancing moves a peer to another ring only once its latency
+// leaves the range of its ring by more than the hysteresis, and that removing
+// a peer forgets its latency.
+func TestRebalanceHysteresis(t *testing.T) {
+	var latency int64 = int64(200 * time.Millisecond)
+	config := NewDefaultRingsConfig(func(_ peer.ID) (time.Duration, error) {
+		return time.Duration(atomic.LoadInt64(&latency)), nil
+	})
+	config.SamplePeriod = time.Hour
+	table := NewRingsRoutingTable(config)
+	defer table.Shutdown()
+	rings := table.(*ringsRoutingTable)
+
+	pid := uniquePIDs(1)[0]
+	table.Add(pid)
+	ring := func() int {
+		rings.RLock()
+		defer rings.RUnlock()
+		if i, placed := rings.placement[pid]; placed {
+			return i
+		}
+		return -1
+	}
+	for i := 0; ring() == -1; i++ {
+		if i == 100 {
+			t.Fatal("Peer was not placed into a ring")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	initial := ring()
+
+	// Slightly above the range of the ring, the peer stays.
+	atomic.StoreInt64(&latency, int64(270*time.Millisecond))
+	for i := 0; i < 100; i++ {
+		rings.refreshLatency()
+		rings.rebalance()
+	}
+	if ring() != initial {
+		t.Fatalf("Peer moved from ring %v to ring %v within the hysteresis", initial, ring())
+	}
+
+	// Well above the range of the ring, the peer moves.
+	atomic.StoreInt64(&latency, int64(400*time.Millisecond))
+	for i := 0; i < 100; i++ {
+		rings.refreshLatency()
+		rings.rebalance()
+	}
+	if ring() != initial+1 {
+		t.Fatalf("Expected peer in ring %v, got %v", initial+1, ring())
+	}
+	stats := table.Stats()
+	if stats.Moves != 1 || stats.Occupancy[initial+1] != 1 || stats.Unplaced != 0 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+
+	table.Remove(pid)
+	rings.RLock()
+	_, exists := rings.metrics[pid]
+	rings.RUnlock()
+	if exists || table.Stats().Occupancy[initial+1] != 0 {
+		t.Fatal("Removed peer is still tracked")
+	}
+}
+
+// Test that a peer with an estimated latency is placed into a ring before its
+// latency probe completes, and that the probe replaces the estimate.
+func TestAddPlacesByEstimate(t *testing.T) {
+	release := make(chan struct{})
+	config := NewDefaultRingsConfig(func(_ peer.ID) (time.Duration, error) {
+		<-release
+		return 20 * time.Millisecond, nil
+	})
+	config.LatencyEstimateFn = func(_ peer.ID) (time.Duration, bool) {
+		return 200 * time.Millisecond, true
+	}
+	table := NewRingsRoutingTable(config)
+	defer table.Shutdown()
+	rings := table.(*ringsRoutingTable)
+
+	pid := uniquePIDs(1)[0]
+	table.Add(pid)
+	rings.RLock()
+	placed := rings.placement[pid]
+	rings.RUnlock()
+	if placed != rings.ringIndex(200*time.Millisecond) {
+		t.Fatalf("Expected peer in ring %v, got %v", rings.ringIndex(200*time.Millisecond), placed)
+	}
+
+	close(release)
+	for i := 0; ; i++ {
+		rings.RLock()
+		latency := rings.metrics[pid]
+		rings.RUnlock()
+		if latency == 20*time.Millisecond {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("Estimate was not replaced, latency is %v", latency)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Test that `Rings` reports the latency range, members and latency of each
+// ring.
+func TestRings(t *testing.T) {
+	table := NewRingsRoutingTable(NewDefaultRingsConfig(fixedLatencyProbe))
+	defer table.Shutdown()
+
+	pids := uniquePIDs(3)
+	for _, pid := range pids {
+		table.Add(pid)
+	}
+	index := table.(*ringsRoutingTable).ringIndex(256 * time.Millisecond)
+	for i := 0; len(table.Rings()[index].Members) != len(pids); i++ {
+		if i == 100 {
+			t.Fatal("Peers were not placed into a ring")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	rings := table.Rings()
+	if len(rings) != 8 {
+		t.Fatalf("Expected 8 rings, got %v", len(rings))
+	}
+	ring := rings[index]
+	if ring.MinLatency >= 256*time.Millisecond || ring.MaxLatency < 256*time.Millisecond {
+		t.Fatalf("Latency range (%v, %v] does not contain 256ms", ring.MinLatency, ring.MaxLatency)
+	}
+	if ring.Latency != 256*time.Millisecond {
+		t.Fatalf("Expected latency of 256ms, got %v", ring.Latency)
+	}
+	for _, member := range ring.Members {
+		if member.Latency != 256*time.Millisecond || member.Estimated {
+			t.Fatalf("Unexpected member %+v", member)
+		}
+	}
+	if rings[len(rings)-1].MaxLatency != 0 {
+		t.Fatal("The last ring should be unbounded")
+	}
+}
+
+// Wait until every peer has been probed once, except the given number of
+// peers whose probes fail.
+func waitForProbes(t *testing.T, table RingsRoutingTable, unplaced int) {
+	for i := 0; ; i++ {
+		stats := table.Stats()
+		if stats.Unplaced == unplaced && stats.Estimated == 0 {
+			return
+		}
+		if i == 100 {
+			t.Fatalf("Peers were not probed: %+v", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Test that peers whose transactions keep failing are evicted, and that silent
+// peers are never recommended.
+func TestEvictUnresponsive(t *testing.T) {
+	pids := uniquePIDs(4)
+	dead := pids[0]
+	config := NewDefaultRingsConfig(fixedLatencyProbe)
+	config.MaxFailures = 2
+	config.SilenceTimeout = 50 * time.Millisecond
+	table := NewRingsRoutingTable(config)
+	defer table.Shutdown()
+
+	for _, pid := range pids {
+		table.Add(pid)
+	}
+	waitForProbes(t, table, 0)
+	table.Observe(dead, Timeout)
+	if !table.Find(dead) {
+		t.Fatal("Peer was evicted after a single failure")
+	}
+	table.Observe(dead, Timeout)
+	if table.Find(dead) || table.Stats().Evictions != 1 {
+		t.Fatalf("Unresponsive peer was not evicted: %+v", table.Stats())
+	}
+
+	// Only the peer that shows signs of life is recommended once the others
+	// go silent.
+	time.Sleep(100 * time.Millisecond)
+	table.Observe(pids[1], Delivered)
+	recommended := table.Recommend(len(pids), nil)
+	if len(recommended) != 1 || recommended[0] != pids[1] {
+		t.Fatalf("Expected only %v, got %v", pids[1], recommended)
+	}
+}
+
+// Test that a peer whose probes keep failing is evicted.
+func TestEvictUnreachable(t *testing.T) {
+	dead := uniquePIDs(1)[0]
+	probed := make(chan struct{}, 1)
+	config := NewDefaultRingsConfig(func(peer.ID) (time.Duration, error) {
+		probed <- struct{}{}
+		return 0, errors.New("unreachable")
+	})
+	config.MaxFailures = 1
+	table := NewRingsRoutingTable(config)
+	defer table.Shutdown()
+
+	table.Add(dead)
+	<-probed
+	for i := 0; table.Find(dead); i++ {
+		if i == 100 {
+			t.Fatal("Unreachable peer was not evicted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Test that a full ring keeps new peers in the replacement cache, and that a
+// replacement takes the place of a removed peer.
+func TestRingCapacity(t *testing.T) {
+	config := NewDefaultRingsConfig(fixedLatencyProbe)
+	config.RingCapacity = 2
+	config.ReplacementCacheSize = 1
+	table := NewRingsRoutingTable(config)
+	defer table.Shutdown()
+
+	pids := uniquePIDs(4)
+	for _, pid := range pids {
+		table.Add(pid)
+	}
+	waitForProbes(t, table, 0)
+	stats := table.Stats()
+	if table.Size() != 2 || stats.Replacements != 1 {
+		t.Fatalf("Expected 2 peers and 1 replacement, got %v and %+v", table.Size(), stats)
+	}
+
+	// The candidate replaces the removed peer.
+	table.Remove(table.ListPeers()[0])
+	if table.Size() != 2 || table.Stats().Replacements != 0 {
+		t.Fatalf("Replacement was not promoted: %v", table.ListPeers())
+	}
+}
+
+// Test that the table reports each peer that it evicts or demotes, and that a
+// replacement that is added again re-enters the table.
+func TestOnEvict(t *testing.T) {
+	config := NewDefaultRingsConfig(fixedLatencyProbe)
+	config.RingCapacity = 1
+	config.ReplacementCacheSize = 1
+	table := NewRingsRoutingTable(config)
+	defer table.Shutdown()
+	evicted := make(chan peer.ID, 4)
+	table.OnEvict(func(pid peer.ID) {
+		evicted <- pid
+	})
+	expect := func(pid peer.ID) {
+		select {
+		case got := <-evicted:
+			if got != pid {
+				t.Fatalf("Expected %v to be evicted, got %v", pid, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Eviction of %v was not reported", pid)
+		}
+	}
+
+	pids := uniquePIDs(2)
+	table.Add(pids[0])
+	waitForProbes(t, table, 0)
+	table.Add(pids[1])
+	waitForProbes(t, table, 0)
+	expect(pids[1])
+	if table.Find(pids[1]) || table.Stats().Replacements != 1 {
+		t.Fatalf("Expected %v to be a replacement: %+v", pids[1], table.Stats())
+	}
+
+	// The replacement re-enters the table, and is demoted again once its
+	// probe shows that its ring is still full.
+	table.Add(pids[1])
+	if !table.Find(pids[1]) || table.Stats().Replacements != 0 {
+		t.Fatalf("Replacement was not added again: %+v", table.Stats())
+	}
+	waitForProbes(t, table, 0)
+	expect(pids[1])
+
+	// An unresponsive peer is evicted and replaced.
+	for i := 0; i < config.MaxFailures; i++ {
+		table.Observe(pids[0], Timeout)
+	}
+	expect(pids[0])
+	if table.Find(pids[0]) || !table.Find(pids[1]) {
+		t.Fatalf("Replacement did not take the place of the evicted peer: %v", table.ListPeers())
+	}
+}
+
+// Test that the score of a peer reflects both its behaviour and its latency,
+// and survives its removal.
+func TestScore(t *testing.T) {
+	latencies := make(map[peer.ID]time.Duration)
+	pids := uniquePIDs(3)
+	latencies[pids[0]] = 10 * time.Millisecond
+	latencies[pids[1]] = 10 * time.Millisecond
+	latencies[pids[2]] = 500 * time.Millisecond
+	table := NewRingsRoutingTable(NewDefaultRingsConfig(func(pid peer.ID) (time.Duration, error) {
+		return latencies[pid], nil
+	}))
+	defer table.Shutdown()
+
+	for _, pid := range pids {
+		table.Add(pid)
+	}
+	waitForProbes(t, table, 0)
+	for i := 0; i < 8; i++ {
+		table.Observe(pids[1], Timeout)
+		table.Observe(pids[1], Stale)
+	}
+	if table.Score(pids[1]) >= table.Score(pids[0]) {
+		t.Fatal("Misbehaving peer outscores well-behaved peer")
+	}
+	if table.Score(pids[2]) >= table.Score(pids[0]) {
+		t.Fatal("Slow peer outscores fast peer")
+	}
+
+	score := table.Score(pids[1])
+	table.Remove(pids[1])
+	if table.Score(pids[1]) != score {
+		t.Fatal("Score was lost when the peer was removed")
+	}
+}
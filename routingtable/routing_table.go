@@ -12,15 +12,38 @@ type RoutingTable interface {
 	// Remove a peer from a routing table.
 	Remove(pid peer.ID)
 
+	// Update a peer in a routing table, i.e. add it or mark it as recently
+	// seen.
+	Update(pid peer.ID)
+
+	// Find returns true if a peer is in a routing table.
+	Find(pid peer.ID) bool
+
+	// ListPeers returns all peers in a routing table.
+	ListPeers() []peer.ID
+
 	// Recommend a slice of peers from a routing table for gossiping purposes.
 	// It also accepts a list of excluded peers, which won't be included in the
 	// recommended list.  The idea is that the caller may not want to gossip to
 	// these peers because they might already have the artifact.
 	Recommend(count int, exclude []peer.ID) []peer.ID
 
+	// Observe records an event that affects the reputation of a peer.
+	// Implementations may prefer peers with a good reputation in Recommend.
+	Observe(pid peer.ID, event Event)
+
+	// Score returns the score of a peer between zero and one, where higher is
+	// better, by its reputation and latency.  Peers that are no longer in the
+	// routing table keep their score for a while.
+	Score(pid peer.ID) float64
+
 	// Size returns the number of peers in the routing table.
 	Size() int
 
 	// Shutdown cleans up any resources that the RoutingTable might've allocated
 	Shutdown()
 }
+
+// Factory creates a RoutingTable for the local peer, given a function for
+// probing the latency of other peers.
+type Factory func(self peer.ID, probe LatencyProbeFn) RoutingTable
@@ -0,0 +1,52 @@
+/**
+ * File        : churn.go
+ * Description : Models of nodes joining and leaving the network.
+ * Copyright   : Copyright (c) 2017-2018 DFINITY Stiftung. All rights reserved.
+ * Maintainer  : Enzo Haussecker <enzo@dfinity.org>
+ * Stability   : Experimental
+ */
+
+package simulator
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"time"
+)
+
+// ChurnModel decides whether a node is online at a given virtual time.  It
+// must return the same answer when asked the same question.
+type ChurnModel interface {
+	Online(node int, at time.Duration) bool
+}
+
+// NoChurn keeps every node online.
+type NoChurn struct{}
+
+// Online implements ChurnModel.
+func (NoChurn) Online(int, time.Duration) bool {
+	return true
+}
+
+// RandomChurn takes each node offline with the given probability for each
+// period, independently of other nodes and periods.
+type RandomChurn struct {
+	Offline float64
+	Period  time.Duration
+	Seed    int64
+}
+
+// Online implements ChurnModel.
+func (churn RandomChurn) Online(node int, at time.Duration) bool {
+	var epoch int64
+	if churn.Period > 0 {
+		epoch = int64(at / churn.Period)
+	}
+	var data [24]byte
+	binary.BigEndian.PutUint64(data[0:], uint64(churn.Seed))
+	binary.BigEndian.PutUint64(data[8:], uint64(node))
+	binary.BigEndian.PutUint64(data[16:], uint64(epoch))
+	hash := fnv.New64a()
+	hash.Write(data[:])
+	return float64(hash.Sum64()>>11)/(1<<53) >= churn.Offline
+}
@@ -0,0 +1,385 @@
+/**
+ * File        : simulator.go
+ * Description : Discrete-event gossip simulator.
+ * Copyright   : Copyright (c) 2017-2018 DFINITY Stiftung. All rights reserved.
+ * Maintainer  : Enzo Haussecker <enzo@dfinity.org>
+ * Stability   : Experimental
+ */
+
+package simulator
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+
+	"gx/ipfs/QmPgDWmTmuzvP7QE5zwo1TmjbJme9pmZHNujB2453jkCTr/go-libp2p-peerstore"
+	"gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
+
+	"github.com/dfinity/go-revolver/routingtable"
+)
+
+// Factory creates the routing table of a simulated node, given a latency probe
+// that looks up the latency matrix, and a source of randomness and a virtual
+// clock that make the simulation reproducible.
+type Factory func(self peer.ID, probe routingtable.LatencyProbeFn, source rand.Source, clock func() time.Time) routingtable.RoutingTable
+
+// FanoutPolicy returns the number of peers that a node forwards an artifact
+// to, given the number of hops that the artifact has travelled.
+type FanoutPolicy func(hops int) int
+
+// Config configures a simulation.
+type Config struct {
+	// The round-trip time between each pair of nodes.  An artifact takes half
+	// of it to travel from one node to another.
+	Latency [][]time.Duration
+
+	// Creates the routing table of each node, and the number of random peers
+	// that each node adds to its routing table.
+	Factory Factory
+	Degree  int
+
+	// Decides how many peers a node forwards an artifact to.
+	Fanout FanoutPolicy
+
+	// Decides which nodes are online.  Nil means that all nodes are.
+	Churn ChurnModel
+
+	// The number of artifacts, which are broadcast by random online nodes at
+	// the given interval.
+	Artifacts int
+	Interval  time.Duration
+
+	// The seed of all randomness in the simulation.
+	Seed int64
+}
+
+// Report summarizes a simulation.
+type Report struct {
+	// Percentiles of the time until a node first receives an artifact.
+	P50 time.Duration
+	P90 time.Duration
+	P99 time.Duration
+	Max time.Duration
+
+	// The fraction of the nodes online when an artifact is broadcast that
+	// receive it, on average.
+	Coverage float64
+
+	// The number of copies of an artifact that a node receives, on average,
+	// among the nodes that receive it.
+	Redundancy float64
+
+	// The number of messages sent, including those that were lost.
+	Messages int
+}
+
+// Rings creates a Factory for rings routing tables with the given config.
+// Peers are probed as soon as they are added and go silent by the virtual
+// clock, and the rings are never re-balanced, since latencies do not change.
+func Rings(conf routingtable.RingsConfig) Factory {
+	return func(self peer.ID, probe routingtable.LatencyProbeFn, source rand.Source, clock func() time.Time) routingtable.RoutingTable {
+		conf := conf
+		conf.LatencyProbFn = probe
+		conf.SyncProbes = true
+		conf.Clock = clock
+		conf.SamplePeriod = math.MaxInt64
+		conf.RandomSource = source
+		return routingtable.NewRingsRoutingTable(conf)
+	}
+}
+
+// Kademlia creates a Factory for Kademlia routing tables with the given bucket
+// size.
+func Kademlia(bucketSize int) Factory {
+	return func(self peer.ID, _ routingtable.LatencyProbeFn, source rand.Source, _ func() time.Time) routingtable.RoutingTable {
+		return routingtable.NewKademliaRoutingTable(self, routingtable.KademliaConfig{
+			BucketSize:       bucketSize,
+			LatencyTolerance: time.Minute,
+			Metrics:          peerstore.NewMetrics(),
+			RandomSource:     source,
+		})
+	}
+}
+
+// ConstantFanout creates a FanoutPolicy that forwards every artifact to the
+// same number of peers.
+func ConstantFanout(fanout int) FanoutPolicy {
+	return func(int) int {
+		return fanout
+	}
+}
+
+// EuclideanLatencies creates a latency matrix for nodes at random points in a
+// square, where the round-trip time is one millisecond plus the distance
+// between the points.
+func EuclideanLatencies(n int, side time.Duration, seed int64) [][]time.Duration {
+	random := rand.New(rand.NewSource(seed))
+	x := make([]float64, n)
+	y := make([]float64, n)
+	for i := range x {
+		x[i] = random.Float64() * float64(side)
+		y[i] = random.Float64() * float64(side)
+	}
+	latency := make([][]time.Duration, n)
+	for i := range latency {
+		latency[i] = make([]time.Duration, n)
+		for j := range latency[i] {
+			if i != j {
+				latency[i][j] = time.Millisecond + time.Duration(math.Hypot(x[i]-x[j], y[i]-y[j]))
+			}
+		}
+	}
+	return latency
+}
+
+// An event is the arrival of an artifact at a node.
+type event struct {
+	at       time.Duration
+	seq      int
+	artifact int
+	from     int
+	to       int
+	hops     int
+}
+
+// The events in the order that they happen.  Simultaneous events happen in the
+// order that they were scheduled.
+type queue []event
+
+func (q queue) Len() int { return len(q) }
+func (q queue) Less(i, j int) bool {
+	return q[i].at < q[j].at || q[i].at == q[j].at && q[i].seq < q[j].seq
+}
+func (q queue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *queue) Push(x interface{}) { *q = append(*q, x.(event)) }
+func (q *queue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
+
+func (conf *Config) validate() error {
+	n := len(conf.Latency)
+	if n < 2 {
+		return errors.New("Too few nodes")
+	}
+	for i := range conf.Latency {
+		if len(conf.Latency[i]) != n {
+			return fmt.Errorf("Invalid latency matrix: row %d has %d columns", i, len(conf.Latency[i]))
+		}
+	}
+	if conf.Factory == nil {
+		return errors.New("Missing routing table factory")
+	}
+	if conf.Degree <= 0 || conf.Degree >= n {
+		return fmt.Errorf("Invalid degree: %d", conf.Degree)
+	}
+	if conf.Fanout == nil {
+		return errors.New("Missing fanout policy")
+	}
+	if conf.Artifacts <= 0 {
+		return fmt.Errorf("Invalid number of artifacts: %d", conf.Artifacts)
+	}
+	if conf.Interval < 0 {
+		return fmt.Errorf("Invalid interval: %d", conf.Interval)
+	}
+	return nil
+}
+
+// Run a simulation.  Given the same config, it always returns the same
+// report.
+func Run(conf Config) (Report, error) {
+
+	var report Report
+	err := conf.validate()
+	if err != nil {
+		return report, err
+	}
+	churn := conf.Churn
+	if churn == nil {
+		churn = NoChurn{}
+	}
+	n := len(conf.Latency)
+	random := rand.New(rand.NewSource(conf.Seed))
+
+	// The virtual clock, which follows the events.
+	var now time.Duration
+	clock := func() time.Time {
+		return time.Unix(0, 0).Add(now)
+	}
+
+	// Create the nodes.
+	ids := make([]peer.ID, n)
+	index := make(map[peer.ID]int)
+	for i := range ids {
+		ids[i] = peer.ID(fmt.Sprintf("node-%d", i))
+		index[ids[i]] = i
+	}
+	tables := make([]routingtable.RoutingTable, n)
+	for i := range tables {
+		latency := conf.Latency[i]
+		probe := func(pid peer.ID) (time.Duration, error) {
+			j, exists := index[pid]
+			if !exists {
+				return 0, errors.New("Unknown peer")
+			}
+			return latency[j], nil
+		}
+		tables[i] = conf.Factory(ids[i], probe, rand.NewSource(random.Int63()), clock)
+		defer tables[i].Shutdown()
+	}
+
+	// Let each node know some random peers.
+	for i := range tables {
+		added := 0
+		for _, j := range random.Perm(n) {
+			if added == conf.Degree {
+				break
+			}
+			if j != i {
+				tables[i].Add(ids[j])
+				added++
+			}
+		}
+	}
+
+	// Schedule the broadcasts.
+	events := &queue{}
+	seq := 0
+	online := make([]map[int]bool, conf.Artifacts)
+	for a := 0; a < conf.Artifacts; a++ {
+		at := time.Duration(a) * conf.Interval
+		var candidates []int
+		online[a] = make(map[int]bool)
+		for i := 0; i < n; i++ {
+			if churn.Online(i, at) {
+				candidates = append(candidates, i)
+				online[a][i] = true
+			}
+		}
+		if len(candidates) == 0 {
+			continue
+		}
+		origin := candidates[random.Intn(len(candidates))]
+		heap.Push(events, event{at: at, seq: seq, artifact: a, from: -1, to: origin})
+		seq++
+	}
+
+	// Run the events.
+	first := make([]map[int]time.Duration, conf.Artifacts)
+	copies := make([]map[int]int, conf.Artifacts)
+	for a := range first {
+		first[a] = make(map[int]time.Duration)
+		copies[a] = make(map[int]int)
+	}
+	start := make([]time.Duration, conf.Artifacts)
+	for events.Len() > 0 {
+		e := heap.Pop(events).(event)
+		now = e.at
+
+		// The artifact is lost if the node is offline.
+		if !churn.Online(e.to, e.at) {
+			if e.from >= 0 {
+				tables[e.from].Observe(ids[e.to], routingtable.Timeout)
+			}
+			continue
+		}
+
+		// Count the copies that the node receives.
+		if e.from < 0 {
+			start[e.artifact] = e.at
+		} else {
+			tables[e.from].Observe(ids[e.to], routingtable.Delivered)
+			copies[e.artifact][e.to]++
+		}
+		if _, seen := first[e.artifact][e.to]; seen {
+			tables[e.to].Observe(ids[e.from], routingtable.Stale)
+			continue
+		}
+		first[e.artifact][e.to] = e.at
+		if e.from >= 0 {
+			tables[e.to].Observe(ids[e.from], routingtable.Fresh)
+		}
+
+		// Forward the artifact.
+		var exclude []peer.ID
+		if e.from >= 0 {
+			exclude = append(exclude, ids[e.from])
+		}
+		for _, pid := range tables[e.to].Recommend(conf.Fanout(e.hops), exclude) {
+			j, exists := index[pid]
+			if !exists || j == e.to {
+				continue
+			}
+			heap.Push(events, event{
+				at:       e.at + conf.Latency[e.to][j]/2,
+				seq:      seq,
+				artifact: e.artifact,
+				from:     e.to,
+				to:       j,
+				hops:     e.hops + 1,
+			})
+			seq++
+			report.Messages++
+		}
+	}
+
+	// Summarize the results.
+	var delays []time.Duration
+	var coverage, redundancy float64
+	var reached int
+	for a := 0; a < conf.Artifacts; a++ {
+		if len(online[a]) == 0 {
+			continue
+		}
+
+		// Only the nodes that were online at the broadcast count towards
+		// coverage, so that it never exceeds one under churn.
+		covered := 0
+		for node := range first[a] {
+			if online[a][node] {
+				covered++
+			}
+		}
+		coverage += float64(covered) / float64(len(online[a]))
+		for node, at := range first[a] {
+			if copies[a][node] > 0 {
+				delays = append(delays, at-start[a])
+				redundancy += float64(copies[a][node])
+				reached++
+			}
+		}
+	}
+	report.Coverage = coverage / float64(conf.Artifacts)
+	if reached > 0 {
+		report.Redundancy = redundancy / float64(reached)
+	}
+	sort.Slice(delays, func(i, j int) bool {
+		return delays[i] < delays[j]
+	})
+	report.P50 = percentile(delays, 0.5)
+	report.P90 = percentile(delays, 0.9)
+	report.P99 = percentile(delays, 0.99)
+	report.Max = percentile(delays, 1)
+
+	return report, nil
+
+}
+
+// Get a percentile of sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
@@ -0,0 +1,114 @@
+/**
+ * File        : simulator_test.go
+ * Description : Unit tests.
+ * Copyright   : Copyright (c) 2017-2018 DFINITY Stiftung. All rights reserved.
+ * Maintainer  : Enzo Haussecker <enzo@dfinity.org>
+ * Stability   : Experimental
+ */
+
+package simulator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dfinity/go-revolver/routingtable"
+)
+
+// Create a simulation config for a small network.
+func newTestConfig(factory Factory, churn ChurnModel) Config {
+	return Config{
+		Latency:   EuclideanLatencies(64, 200*time.Millisecond, 0),
+		Factory:   factory,
+		Degree:    16,
+		Fanout:    ConstantFanout(4),
+		Churn:     churn,
+		Artifacts: 32,
+		Interval:  time.Second,
+		Seed:      42,
+	}
+}
+
+// Test that the same config always gives the same report.
+func TestDeterminism(test *testing.T) {
+
+	factories := map[string]Factory{
+		"rings":    Rings(routingtable.NewDefaultRingsConfig(nil)),
+		"kademlia": Kademlia(20),
+	}
+	churn := RandomChurn{Offline: 0.1, Period: 5 * time.Second, Seed: 7}
+
+	for name, factory := range factories {
+		a, err := Run(newTestConfig(factory, churn))
+		if err != nil {
+			test.Fatal(err)
+		}
+		b, err := Run(newTestConfig(factory, churn))
+		if err != nil {
+			test.Fatal(err)
+		}
+		if a != b {
+			test.Fatalf("%s: different reports for the same config: %+v and %+v", name, a, b)
+		}
+	}
+
+}
+
+// Test that gossip reaches the network and that churn reduces coverage.
+func TestCoverage(test *testing.T) {
+
+	factory := Rings(routingtable.NewDefaultRingsConfig(nil))
+
+	report, err := Run(newTestConfig(factory, nil))
+	if err != nil {
+		test.Fatal(err)
+	}
+	if report.Coverage < 0.9 {
+		test.Fatalf("Coverage without churn is too low: %+v", report)
+	}
+	if report.Redundancy < 1 || report.P50 <= 0 || report.P50 > report.P90 || report.P90 > report.P99 || report.P99 > report.Max {
+		test.Fatalf("Invalid report: %+v", report)
+	}
+
+	churned, err := Run(newTestConfig(factory, RandomChurn{Offline: 0.5, Period: time.Second, Seed: 7}))
+	if err != nil {
+		test.Fatal(err)
+	}
+	if churned.Coverage <= 0 || churned.Coverage > report.Coverage {
+		test.Fatalf("Unexpected coverage with churn: %+v", churned)
+	}
+
+}
+
+// A churn model in which the odd nodes are offline whenever an artifact is
+// broadcast, but online when it reaches them.
+type lateChurn struct{}
+
+func (lateChurn) Online(node int, at time.Duration) bool {
+	return node%2 == 0 || at%time.Second != 0
+}
+
+// Test that coverage only counts the nodes that were online at the broadcast.
+func TestCoverageUnderChurn(test *testing.T) {
+
+	report, err := Run(newTestConfig(Rings(routingtable.NewDefaultRingsConfig(nil)), lateChurn{}))
+	if err != nil {
+		test.Fatal(err)
+	}
+	if report.Coverage <= 0 || report.Coverage > 1 {
+		test.Fatalf("Coverage is out of range: %+v", report)
+	}
+
+}
+
+// Test that invalid configs are rejected.
+func TestInvalidConfig(test *testing.T) {
+
+	conf := newTestConfig(Kademlia(20), nil)
+	conf.Degree = len(conf.Latency)
+	_, err := Run(conf)
+	if err == nil {
+		test.Fatal("Expected an error for an invalid degree")
+	}
+
+}
@@ -0,0 +1,67 @@
+/**
+ * File        : heartbeat.go
+ * Description : Detection of idle and dead streams.
+ * Copyright   : Copyright (c) 2017-2018 DFINITY Stiftung. All rights reserved.
+ * Maintainer  : Enzo Haussecker <enzo@dfinity.org>
+ * Stability   : Stable
+ */
+
+package streamstore
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+
+	"gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
+
+	"github.com/dfinity/go-revolver/util"
+)
+
+// Periodically send heartbeats on idle streams and remove silent peers until
+// the stream store is shut down.
+func (ss *streamstore) monitor() {
+	period := ss.conf.HeartbeatInterval
+	if period <= 0 || ss.conf.IdleTimeout > 0 && ss.conf.IdleTimeout/2 < period {
+		period = ss.conf.IdleTimeout / 2
+	}
+	for {
+		select {
+		case <-ss.shutdown:
+			return
+		case <-time.After(period):
+			ss.check(time.Now())
+		}
+	}
+}
+
+// Check the streams for inactivity as of the given time.
+func (ss *streamstore) check(now time.Time) {
+	var idle, silent []peer.ID
+	for pid, ctx := range ss.load().peers {
+		lastRead := time.Unix(0, atomic.LoadInt64(&ctx.lastRead))
+		lastWrite := time.Unix(0, atomic.LoadInt64(&ctx.lastWrite))
+		switch {
+		case ss.conf.IdleTimeout > 0 && now.Sub(lastRead) >= ss.conf.IdleTimeout:
+			silent = append(silent, pid)
+		case ss.conf.HeartbeatInterval > 0 && now.Sub(lastWrite) >= ss.conf.HeartbeatInterval:
+			idle = append(idle, pid)
+		}
+	}
+
+	// Remove the peers that went silent.
+	for _, pid := range silent {
+		ss.Debug("Peer", pid, "went silent")
+		ss.Remove(pid)
+		if ss.conf.IdleFn != nil {
+			ss.conf.IdleFn(pid)
+		}
+	}
+
+	// Let the other peers know that we are still alive.
+	if len(idle) > 0 {
+		ss.ApplyControlTo(func(pid peer.ID, writer io.Writer) error {
+			return util.WriteWithTimeout(writer, ss.conf.Heartbeat, ss.conf.HeartbeatInterval)
+		}, idle)
+	}
+}
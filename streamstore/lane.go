@@ -0,0 +1,154 @@
+/**
+ * File        : lane.go
+ * Description : Control and bulk lanes for each peer.
+ * Copyright   : Copyright (c) 2017-2018 DFINITY Stiftung. All rights reserved.
+ * Maintainer  : Enzo Haussecker <enzo@dfinity.org>
+ * Stability   : Stable
+ */
+
+package streamstore
+
+import (
+	"context"
+	"io"
+	"math"
+	"sync"
+
+	"gx/ipfs/QmNa31VPzC561NWwRsJLE7nGYZYuuD2QfpK2b1q9BK54J1/go-libp2p-net"
+	"gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
+)
+
+// The transaction queue of a lane.  Unlike a channel, it lets a cancelled
+// transaction leave the queue before it starts, so that it no longer counts
+// towards the size of the queue.
+type txQueue struct {
+	closed bool
+	items  []transaction
+	size   int
+	cond   *sync.Cond
+	sync.Mutex
+}
+
+func newTxQueue(size int) *txQueue {
+	queue := &txQueue{size: size}
+	queue.cond = sync.NewCond(queue)
+	return queue
+}
+
+// Queue a transaction unless the queue is full or closed.
+func (q *txQueue) push(tx transaction) error {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		return errClosed
+	}
+	if len(q.items) >= q.size {
+		return ErrQueueFull
+	}
+	q.items = append(q.items, tx)
+	q.cond.Signal()
+	return nil
+}
+
+// Wait for the next transaction.  Returns false once the queue is closed and
+// empty.
+func (q *txQueue) pop() (transaction, bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	for len(q.items) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.items) == 0 {
+		return transaction{}, false
+	}
+	tx := q.items[0]
+	q.items[0] = transaction{}
+	q.items = q.items[1:]
+	return tx, true
+}
+
+// Remove a transaction that has not started yet.  Returns false if it is no
+// longer in the queue.
+func (q *txQueue) remove(tx transaction) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	for i := range q.items {
+		if q.items[i].Mutex == tx.Mutex {
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Refuse new transactions, and let the worker finish once the queued ones
+// are done.
+func (q *txQueue) close() {
+	q.Lock()
+	defer q.Unlock()
+
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// Run the transactions of a lane on its stream until the lane is closed.
+func (ss *streamstore) work(pid peer.ID, ctx *peerctx, queue *txQueue, stream net.Stream) {
+	for {
+		tx, ok := queue.pop()
+		if !ok {
+			return
+		}
+		outcome := ss.process(pid, ctx, stream, tx)
+		ss.Debug("Recording result for", pid)
+		tx.Lock()
+		tx.outcomes[pid] = outcome
+		tx.result[pid] <- outcome.Err
+		tx.Unlock()
+	}
+}
+
+func (ss *streamstore) AddControl(pid peer.ID, stream net.Stream) bool {
+	ctx, exists := ss.load().peers[pid]
+	if !exists {
+		ss.Debug("Cannot add control stream for", pid, "to stream store: not paired")
+		return false
+	}
+
+	ctx.Lock()
+	defer ctx.Unlock()
+
+	if ctx.closed || ctx.controlStream != nil {
+		ss.Debug("Cannot add control stream for", pid, "to stream store")
+		return false
+	}
+	ss.Debug("Adding control stream", pid, "to stream store")
+	ctx.controlStream = stream
+	ctx.workers.Add(1)
+	go func() {
+		defer ctx.workers.Done()
+		ss.work(pid, ctx, ctx.control, stream)
+	}()
+	return true
+}
+
+func (ss *streamstore) ApplyControl(f func(peer.ID, io.Writer) error, exclude peer.IDSlice) map[peer.ID]chan error {
+	return ss.ApplyControlN(f, int(math.Sqrt(float64(ss.InboundCapacity()+ss.OutboundCapacity()))), exclude)
+}
+
+func (ss *streamstore) ApplyControlN(f func(peer.ID, io.Writer) error, count int, exclude peer.IDSlice) map[peer.ID]chan error {
+	pids := ss.routingTable.Recommend(count, exclude)
+	return ss.apply(newControlTransaction(f), exclude, pids)
+}
+
+func (ss *streamstore) ApplyControlTo(f func(peer.ID, io.Writer) error, peers peer.IDSlice) map[peer.ID]chan error {
+	return ss.apply(newControlTransaction(f), nil, peers)
+}
+
+func newControlTransaction(f func(peer.ID, io.Writer) error) transaction {
+	tx := newTransaction(context.Background(), f)
+	tx.control = true
+	return tx
+}
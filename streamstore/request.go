@@ -0,0 +1,216 @@
+/**
+ * File        : request.go
+ * Description : Request/response exchanges over paired streams.
+ * Copyright   : Copyright (c) 2017-2018 DFINITY Stiftung. All rights reserved.
+ * Maintainer  : Enzo Haussecker <enzo@dfinity.org>
+ * Stability   : Stable
+ */
+
+package streamstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
+
+	"github.com/dfinity/go-revolver/util"
+)
+
+// ErrNotPaired is returned for a request to a peer that has no stream in the
+// stream store.
+var ErrNotPaired = errors.New("peer is not in the stream store")
+
+// The reply to a request, which is either a response or the error that the
+// peer reported instead.
+type reply struct {
+	data []byte
+	err  error
+}
+
+// Encode a request or response frame.  The frame consists of its type, the
+// request identifier, the size of the payload and the payload itself.
+func encodeFrame(frame byte, id uint32, payload []byte) []byte {
+	data := make([]byte, 0, 9+len(payload))
+	data = append(data, frame)
+	code := util.EncodeBigEndianUInt32(id)
+	data = append(data, code[:]...)
+	size := util.EncodeBigEndianUInt32(uint32(len(payload)))
+	data = append(data, size[:]...)
+	return append(data, payload...)
+}
+
+func (ss *streamstore) Request(ctx context.Context, pid peer.ID, request []byte) ([]byte, error) {
+	if uint32(len(request)) > ss.conf.MaxMessageSize {
+		return nil, fmt.Errorf("cannot send %d byte request", len(request))
+	}
+
+	// Register the request before sending it, so that the response cannot
+	// arrive first.
+	id := atomic.AddUint32(&ss.nextRequest, 1)
+	response := make(chan reply, 1)
+	ss.pendingLock.Lock()
+	if ss.pending[pid] == nil {
+		ss.pending[pid] = make(map[uint32]chan reply)
+	}
+	ss.pending[pid][id] = response
+	ss.pendingLock.Unlock()
+	defer func() {
+		ss.pendingLock.Lock()
+		delete(ss.pending[pid], id)
+		if len(ss.pending[pid]) == 0 {
+			delete(ss.pending, pid)
+		}
+		ss.pendingLock.Unlock()
+	}()
+
+	// Send the request as a single write, so that it is not interleaved with
+	// other transactions, and give up on it by the write timeout or the
+	// deadline of the context, whichever comes first.
+	frame := encodeFrame(ss.conf.RequestFrame, id, request)
+	timeout := ss.conf.WriteTimeout
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+	tx := newTransaction(ctx, func(_ peer.ID, writer io.Writer) error {
+		return util.WriteWithTimeout(writer, frame, timeout)
+	})
+	tx.control = true
+	results := ss.apply(tx, nil, peer.IDSlice{pid})
+	result, exists := results[pid]
+	if !exists {
+		return nil, ErrNotPaired
+	}
+	select {
+	case err := <-result:
+		if err != nil {
+			return nil, err
+		}
+	case <-ctx.Done():
+		if queue, exists := tx.queues[pid]; exists {
+			queue.remove(tx)
+		}
+		return nil, ctx.Err()
+	}
+
+	// Wait for the response.
+	select {
+	case reply, ok := <-response:
+		if !ok {
+			return nil, ErrNotPaired
+		}
+		return reply.data, reply.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (ss *streamstore) Serve(pid peer.ID, frame byte, reader io.Reader) error {
+	var header [8]byte
+	_, err := io.ReadFull(reader, header[:])
+	if err != nil {
+		return err
+	}
+	var code, size [4]byte
+	copy(code[:], header[:4])
+	copy(size[:], header[4:])
+	id := util.DecodeBigEndianUInt32(code)
+	n := util.DecodeBigEndianUInt32(size)
+	if n > ss.conf.MaxMessageSize {
+		return fmt.Errorf("cannot accept %d byte message from %v", n, pid)
+	}
+	payload := make([]byte, n)
+	_, err = io.ReadFull(reader, payload)
+	if err != nil {
+		return err
+	}
+
+	switch frame {
+
+	// Hand the response to the request waiting for it, if any.
+	case ss.conf.ResponseFrame:
+		ss.deliver(pid, id, reply{data: payload})
+		return nil
+
+	// Hand the error to the request waiting for it, if any.
+	case ss.conf.ErrorFrame:
+		ss.deliver(pid, id, reply{err: fmt.Errorf("peer cannot answer request: %s", payload)})
+		return nil
+
+	// Answer the request without blocking the reader of the stream, unless
+	// too many requests are being answered already.
+	case ss.conf.RequestFrame:
+		if ss.conf.RequestFn == nil {
+			return errors.New("requests are disabled")
+		}
+		select {
+		case ss.requests <- struct{}{}:
+		default:
+			ss.Debug("Cannot answer request from", pid, "too many requests")
+			ss.respond(pid, id, ss.conf.ErrorFrame, []byte("too many requests"))
+			return nil
+		}
+		go func() {
+			defer func() {
+				<-ss.requests
+			}()
+			response, err := ss.conf.RequestFn(pid, payload)
+			if err != nil {
+				ss.Debug("Cannot answer request from", pid, err)
+				ss.respond(pid, id, ss.conf.ErrorFrame, []byte(err.Error()))
+				return
+			}
+			if uint32(len(response)) > ss.conf.MaxMessageSize {
+				ss.Debug("Cannot send", len(response), "byte response to", pid)
+				ss.respond(pid, id, ss.conf.ErrorFrame, []byte("response is too large"))
+				return
+			}
+			ss.respond(pid, id, ss.conf.ResponseFrame, response)
+		}()
+		return nil
+
+	default:
+		return fmt.Errorf("unknown frame type %#x", frame)
+	}
+}
+
+// Hand a reply to the request waiting for it, if any.
+func (ss *streamstore) deliver(pid peer.ID, id uint32, r reply) {
+	ss.pendingLock.Lock()
+	defer ss.pendingLock.Unlock()
+
+	if response, exists := ss.pending[pid][id]; exists {
+		select {
+		case response <- r:
+		default:
+		}
+	}
+}
+
+// Send a response or error frame to a peer.  Error messages are truncated to
+// the maximum message size.
+func (ss *streamstore) respond(pid peer.ID, id uint32, frame byte, payload []byte) {
+	if uint32(len(payload)) > ss.conf.MaxMessageSize {
+		payload = payload[:ss.conf.MaxMessageSize]
+	}
+	data := encodeFrame(frame, id, payload)
+	ss.ApplyControlTo(func(_ peer.ID, writer io.Writer) error {
+		return util.WriteWithTimeout(writer, data, ss.conf.WriteTimeout)
+	}, peer.IDSlice{pid})
+}
+
+// Fail the outstanding requests to a peer.
+func (ss *streamstore) abandon(pid peer.ID) {
+	ss.pendingLock.Lock()
+	defer ss.pendingLock.Unlock()
+
+	for id, response := range ss.pending[pid] {
+		close(response)
+		delete(ss.pending[pid], id)
+	}
+	delete(ss.pending, pid)
+}
@@ -0,0 +1,95 @@
+/**
+ * File        : score.go
+ * Description : Peer scoring and stream eviction.
+ * Copyright   : Copyright (c) 2017-2018 DFINITY Stiftung. All rights reserved.
+ * Maintainer  : Enzo Haussecker <enzo@dfinity.org>
+ * Stability   : Stable
+ */
+
+package streamstore
+
+import (
+	"math"
+	"time"
+
+	"gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
+
+	"github.com/dfinity/go-revolver/routingtable"
+)
+
+func (ss *streamstore) Observe(pid peer.ID, event routingtable.Event) {
+	ss.routingTable.Observe(pid, event)
+}
+
+func (ss *streamstore) Score(pid peer.ID) float64 {
+	return ss.routingTable.Score(pid)
+}
+
+// Evict the worst-scoring stream in the given direction to make room for a
+// candidate. To limit churn, streams are protected for a grace period after
+// they are added, evictions are rate limited, and the candidate must beat the
+// worst score by a margin.  The caller must hold the lock.
+func (ss *streamstore) evict(candidate peer.ID, outbound bool) bool {
+	if ss.conf.EvictionInterval <= 0 {
+		return false
+	}
+
+	now := time.Now()
+	last := &ss.lastInboundEviction
+	if outbound {
+		last = &ss.lastOutboundEviction
+	}
+	if now.Sub(*last) < ss.conf.EvictionInterval {
+		return false
+	}
+
+	worst, worstScore := ss.worst(outbound, now.Add(-ss.conf.EvictionGracePeriod))
+	if math.IsInf(worstScore, 1) || ss.Score(candidate) < worstScore+ss.conf.EvictionMargin {
+		return false
+	}
+
+	ss.Debugf("Evicting %v with score %.3f from stream store in favour of %v", worst, worstScore, candidate)
+	ss.drop(worst)
+	*last = now
+	return true
+}
+
+// Find the worst-scoring stream in the given direction among those added no
+// later than the given time, ignoring trusted peers and reserved slots.  The
+// score is infinite if there is none.
+func (ss *streamstore) worst(outbound bool, before time.Time) (peer.ID, float64) {
+	var worst peer.ID
+	worstScore := math.Inf(1)
+	for pid, ctx := range ss.load().peers {
+		if ctx.outbound != outbound || ctx.reserved || ss.trusted[pid] || ctx.added.After(before) {
+			continue
+		}
+		score := ss.Score(pid)
+		if score < worstScore {
+			worst = pid
+			worstScore = score
+		}
+	}
+	return worst, worstScore
+}
+
+// Remove the worst-scoring streams in the given direction until the stream
+// store is within the given capacity.  The caller must hold the lock.
+func (ss *streamstore) trim(outbound bool, capacity int) {
+	for {
+		current := ss.load()
+		size := current.inbound
+		if outbound {
+			size = current.outbound
+		}
+		if size <= capacity {
+			return
+		}
+		worst, score := ss.worst(outbound, time.Now())
+		if math.IsInf(score, 1) {
+			return
+		}
+		ss.Debugf("Trimming %v with score %.3f from stream store", worst, score)
+		ss.retire(worst)
+	}
+}
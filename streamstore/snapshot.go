@@ -0,0 +1,101 @@
+/**
+ * File        : snapshot.go
+ * Description : Copy-on-write view of the peers in the stream store.
+ * Copyright   : Copyright (c) 2017-2018 DFINITY Stiftung. All rights reserved.
+ * Maintainer  : Enzo Haussecker <enzo@dfinity.org>
+ * Stability   : Stable
+ */
+
+package streamstore
+
+import (
+	"errors"
+
+	"gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
+)
+
+var errClosed = errors.New("stream is closed")
+
+// A snapshot is an immutable view of the peers in the stream store.  Readers
+// load the current snapshot without locking, while writers, which hold the
+// lock, replace it with a modified copy.
+type snapshot struct {
+	peers map[peer.ID]*peerctx
+
+	// The number of streams in each direction, excluding reserved slots.
+	inbound  int
+	outbound int
+
+	// The number of streams in reserved slots.
+	reservedInbound  int
+	reservedOutbound int
+}
+
+// Load the current snapshot.
+func (ss *streamstore) load() *snapshot {
+	return ss.current.Load().(*snapshot)
+}
+
+// Replace the current snapshot with a modified copy.  The caller must hold the
+// lock.
+func (ss *streamstore) modify(f func(map[peer.ID]*peerctx)) {
+	current := ss.load()
+	peers := make(map[peer.ID]*peerctx, len(current.peers)+1)
+	for pid, ctx := range current.peers {
+		peers[pid] = ctx
+	}
+	f(peers)
+	next := &snapshot{peers: peers}
+	for _, ctx := range peers {
+		switch {
+		case ctx.reserved && ctx.outbound:
+			next.reservedOutbound++
+		case ctx.reserved:
+			next.reservedInbound++
+		case ctx.outbound:
+			next.outbound++
+		default:
+			next.inbound++
+		}
+	}
+	ss.current.Store(next)
+}
+
+// Remove a peer and release its stream.  The caller must hold the lock.
+func (ss *streamstore) drop(pid peer.ID) {
+	if ctx := ss.detach(pid); ctx != nil {
+		ctx.Close()
+	}
+}
+
+// Remove a peer and release its stream once its queued transactions are done.
+// The caller must hold the lock.
+func (ss *streamstore) retire(pid peer.ID) {
+	if ctx := ss.detach(pid); ctx != nil {
+		ctx.retire()
+	}
+}
+
+// Remove a peer without releasing its stream.  The caller must hold the lock.
+func (ss *streamstore) detach(pid peer.ID) *peerctx {
+	ctx := ss.unpair(pid)
+	if ctx != nil {
+		ss.routingTable.Remove(pid)
+	}
+	return ctx
+}
+
+// Remove a peer without releasing its stream, but leave the routing table
+// alone.  The caller must hold the lock.
+func (ss *streamstore) unpair(pid peer.ID) *peerctx {
+	ctx, exists := ss.load().peers[pid]
+	if !exists {
+		return nil
+	}
+	ss.Debug("Removing stream", pid, "from stream store")
+	ss.modify(func(peers map[peer.ID]*peerctx) {
+		delete(peers, pid)
+	})
+	ss.abandon(pid)
+	return ctx
+}
@@ -9,11 +9,14 @@
 package streamstore
 
 import (
-	"errors"
+	"context"
+	"fmt"
 	"io"
 	"math"
 	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/enzoh/go-logging"
 	"gx/ipfs/QmNa31VPzC561NWwRsJLE7nGYZYuuD2QfpK2b1q9BK54J1/go-libp2p-net"
@@ -32,6 +35,10 @@ type Streamstore interface {
 	// Remove a stream from the stream store.
 	Remove(peer.ID)
 
+	// Remove a stream from the stream store only if it is still a stream of
+	// the given peer, i.e. it was not replaced.
+	RemoveStream(peer.ID, net.Stream)
+
 	// Remove all streams from the stream store.
 	Purge()
 
@@ -39,117 +46,411 @@ type Streamstore interface {
 	// those specified in a sorted exclude list.
 	Apply(func(peer.ID, io.Writer) error, peer.IDSlice) map[peer.ID]chan error
 
+	// Apply a function to at most a given number of streams in the stream
+	// store except those specified in a sorted exclude list.
+	ApplyN(func(peer.ID, io.Writer) error, int, peer.IDSlice) map[peer.ID]chan error
+
+	// Apply a function to the streams of the specified peers. Peers that have
+	// no stream in the stream store are ignored.
+	ApplyTo(func(peer.ID, io.Writer) error, peer.IDSlice) map[peer.ID]chan error
+
 	// Apply a function to every stream in the stream store except
 	// those specified in a sorted exclude list.
 	ApplyAll(func(peer.ID, io.Writer) error, peer.IDSlice) map[peer.ID]chan error
 
+	// Attach a control stream to a peer in the stream store.  Transactions on
+	// the control lane use it, so they never queue behind bulk transfers.
+	AddControl(peer.ID, net.Stream) bool
+
+	// Like Apply, ApplyN and ApplyTo, but on the control lane.  Without a
+	// control stream, the control lane falls back to the bulk lane.
+	ApplyControl(func(peer.ID, io.Writer) error, peer.IDSlice) map[peer.ID]chan error
+	ApplyControlN(func(peer.ID, io.Writer) error, int, peer.IDSlice) map[peer.ID]chan error
+	ApplyControlTo(func(peer.ID, io.Writer) error, peer.IDSlice) map[peer.ID]chan error
+
+	// Apply a function to a subset of streams in the stream store except
+	// those specified in a sorted exclude list, and wait for the result.
+	// Transactions that have not started when the context is done are
+	// cancelled.
+	ApplyContext(context.Context, func(peer.ID, io.Writer) error, peer.IDSlice) Result
+
 	// Get the peers associated with inbound streams.
 	InboundPeers() []peer.ID
 
 	// Get the peers associated with the outbound streams.
 	OutboundPeers() []peer.ID
 
-	// Get the inbound capacity of the stream store.
+	// Get the inbound capacity of the stream store, excluding reserved slots.
 	InboundCapacity() int
 
-	// Get the outbound capacity of the stream store.
+	// Get the outbound capacity of the stream store, excluding reserved slots.
 	OutboundCapacity() int
 
-	// Get the current number of inbound streams.
+	// Change the capacity of the stream store.  If the capacity shrinks, the
+	// lowest-scoring streams are removed once their queued transactions are
+	// done.
+	SetCapacity(inbound, outbound int) error
+
+	// Get the current number of inbound streams, excluding reserved slots.
 	InboundSize() int
 
-	// Get the current number of outbound streams.
+	// Get the current number of outbound streams, excluding reserved slots.
 	OutboundSize() int
+
+	// Get the current number of inbound and outbound streams in reserved
+	// slots.
+	ReservedSize() (int, int)
+
+	// Check if a peer is trusted.
+	Trusted(peer.ID) bool
+
+	// Send a request to a peer over its stream and wait for the response.
+	// Requests and responses are framed, and each is written to the stream as
+	// a single transaction, so they never interleave with other traffic.
+	Request(context.Context, peer.ID, []byte) ([]byte, error)
+
+	// Read a request or response from the stream of a peer, given a frame
+	// type that has already been read.  Responses are handed to the waiting
+	// request, and requests are answered by the request function.
+	Serve(peer.ID, byte, io.Reader) error
+
+	// Record activity on the stream of a peer.
+	Touch(peer.ID)
+
+	// Record an observation about the quality of a peer.
+	Observe(peer.ID, routingtable.Event)
+
+	// Get the score of a peer between zero and one, where higher is better.
+	Score(peer.ID) float64
+
+	// Get the rings of the routing table, or nil if it does not place peers
+	// in latency rings.
+	Rings() []routingtable.RingInfo
+
+	// Release all resources associated with the stream store.
+	Shutdown()
+}
+
+// Config configures a stream store.
+type Config struct {
+	// The identity of the local peer, which resolves simultaneous pairing.
+	ID peer.ID
+
+	InboundCapacity  int
+	OutboundCapacity int
+	QueueSize        int
+
+	// Trusted peers take reserved slots, which come in addition to the
+	// capacity above, before they compete with everyone else.  Trusted peers
+	// are never evicted.
+	Trusted                  []peer.ID
+	ReservedInboundCapacity  int
+	ReservedOutboundCapacity int
+
+	// A function for retrieving the up-to-date latency information for a given
+	// peer.
+	LatencyProbeFn routingtable.LatencyProbeFn
+
+	// An optional function for estimating the latency of a peer without
+	// contacting it, which the default routing table uses to place new peers.
+	LatencyEstimateFn routingtable.LatencyEstimateFn
+
+	// The message written to an idle stream to show that it is alive, and the
+	// time between such messages.  A zero interval disables heartbeats.
+	Heartbeat         []byte
+	HeartbeatInterval time.Duration
+
+	// The time after which a silent peer is removed from the stream store, and
+	// a function that is called afterwards, as well as after the routing table
+	// evicts a peer.  A zero timeout disables removal.
+	IdleTimeout time.Duration
+	IdleFn      func(peer.ID)
+
+	// When the stream store is full, the worst-scoring stream that is older
+	// than the grace period may be evicted in favour of a candidate whose
+	// score is better by the margin, at most once per interval in each
+	// direction.  A zero interval disables eviction.
+	EvictionGracePeriod time.Duration
+	EvictionInterval    time.Duration
+	EvictionMargin      float64
+
+	// The frame types that mark requests, responses and errors on a stream,
+	// the maximum size of their payloads, and a function that answers
+	// requests.  A nil function disables requests from peers.  An error frame
+	// carries the message of the error that the function returned.
+	RequestFrame   byte
+	ResponseFrame  byte
+	ErrorFrame     byte
+	MaxMessageSize uint32
+	RequestFn      func(peer.ID, []byte) ([]byte, error)
+
+	// The number of requests from all peers that may be answered at once.
+	// Further requests are refused with an error frame.  Zero means 16.
+	RequestWorkers int
+
+	// The time after which a request or response frame that cannot be
+	// written is abandoned, so that a stalled peer holds up neither the
+	// caller nor the lane.  Zero means 10 seconds.
+	WriteTimeout time.Duration
+
+	// The routing table which recommends and scores peers for transactions,
+	// which the caller must shut down itself.  It must hold no peers but those
+	// of the stream store, which adds and removes them as they pair and
+	// unpair, or else it recommends peers that transactions skip.  Nil means a
+	// rings routing table with the config below, whose latency functions and
+	// logger are filled in by the stream store.
+	RoutingTable routingtable.RoutingTable
+	Rings        routingtable.RingsConfig
 }
 
 type streamstore struct {
-	inboundCapacity  int
-	outboundCapacity int
+	inboundCapacity  int64
+	outboundCapacity int64
 
-	peers        map[peer.ID]peerctx
+	current      atomic.Value
 	routingTable routingtable.RoutingTable
 
+	conf     Config
+	trusted  map[peer.ID]bool
+	shutdown chan struct{}
+
+	lastInboundEviction  time.Time
+	lastOutboundEviction time.Time
+
+	pending     map[peer.ID]map[uint32]chan reply
+	pendingLock sync.Mutex
+	nextRequest uint32
+	requests    chan struct{}
+
 	txQueueSize int
 	*logging.Logger
-	sync.RWMutex
+	sync.Mutex
 }
 
 type peerctx struct {
 	outbound bool
-	queue    chan transaction
+	reserved bool
+	queue    *txQueue
 	stream   net.Stream
+	added    time.Time
+
+	// The control lane, which is inactive until a control stream is attached.
+	control       *txQueue
+	controlStream net.Stream
+
+	// Done once both lanes have run their last transaction.
+	workers sync.WaitGroup
+
+	// The times of the last read and write in Unix nanoseconds.
+	lastRead  int64
+	lastWrite int64
+
+	closed bool
+	sync.Mutex
 }
 
 // Release resources associated with this context.
 func (p *peerctx) Close() error {
-	close(p.queue)
+	p.closeQueues()
+	return p.closeStreams()
+}
+
+// Release resources associated with this context once the queued
+// transactions are done.
+func (p *peerctx) retire() {
+	p.closeQueues()
+	go func() {
+		p.workers.Wait()
+		p.closeStreams()
+	}()
+}
+
+func (p *peerctx) closeQueues() {
+	p.Lock()
+	defer p.Unlock()
+
+	if !p.closed {
+		p.closed = true
+		p.queue.close()
+		p.control.close()
+	}
+}
+
+func (p *peerctx) closeStreams() error {
+	p.Lock()
+	control := p.controlStream
+	p.Unlock()
+	if control != nil {
+		control.Close()
+	}
 	return p.stream.Close()
 }
 
+// Queue a transaction unless the queue is full or closed.  Returns the queue
+// of the lane that runs it.
+func (p *peerctx) enqueue(tx transaction) (*txQueue, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.closed {
+		return nil, errClosed
+	}
+	queue := p.queue
+	if tx.control && p.controlStream != nil {
+		queue = p.control
+	}
+	return queue, queue.push(tx)
+}
+
 type transaction struct {
-	query  func(peer.ID, io.Writer) error
-	result map[peer.ID]chan error
+	control  bool
+	ctx      context.Context
+	query    func(peer.ID, io.Writer) error
+	result   map[peer.ID]chan error
+	outcomes map[peer.ID]Outcome
+	queues   map[peer.ID]*txQueue
 	*sync.Mutex
 }
 
+// NewDefaultConfig creates a Config with default parameters.
+func NewDefaultConfig(probe routingtable.LatencyProbeFn) Config {
+	return Config{
+		InboundCapacity:  48,
+		OutboundCapacity: 16,
+		QueueSize:        8192,
+		LatencyProbeFn:   probe,
+
+		EvictionGracePeriod: time.Minute,
+		EvictionInterval:    10 * time.Second,
+		EvictionMargin:      0.05,
+
+		MaxMessageSize: 8192,
+		RequestWorkers: 16,
+		WriteTimeout:   10 * time.Second,
+
+		Rings: routingtable.NewDefaultRingsConfig(nil),
+	}
+}
+
 // New creates a stream store.
 func New(inboundCapacity, outboundCapacity, txQueueSize int, probe routingtable.LatencyProbeFn) Streamstore {
-	return &streamstore{
-		inboundCapacity:  inboundCapacity,
-		outboundCapacity: outboundCapacity,
-		peers:            make(map[peer.ID]peerctx),
-		routingTable:     routingtable.NewRingsRoutingTable(routingtable.NewDefaultRingsConfig(probe)),
-		txQueueSize:      txQueueSize,
+	conf := NewDefaultConfig(probe)
+	conf.InboundCapacity = inboundCapacity
+	conf.OutboundCapacity = outboundCapacity
+	conf.QueueSize = txQueueSize
+	return NewWithConfig(conf)
+}
+
+// NewWithConfig creates a stream store with the given config.
+func NewWithConfig(conf Config) Streamstore {
+	if conf.RequestWorkers <= 0 {
+		conf.RequestWorkers = 16
+	}
+	if conf.WriteTimeout <= 0 {
+		conf.WriteTimeout = 10 * time.Second
+	}
+	ss := &streamstore{
+		inboundCapacity:  int64(conf.InboundCapacity),
+		outboundCapacity: int64(conf.OutboundCapacity),
+		conf:             conf,
+		trusted:          make(map[peer.ID]bool),
+		shutdown:         make(chan struct{}),
+		pending:          make(map[peer.ID]map[uint32]chan reply),
+		requests:         make(chan struct{}, conf.RequestWorkers),
+		txQueueSize:      conf.QueueSize,
 		Logger:           logging.MustGetLogger("streamstore"),
-		RWMutex:          sync.RWMutex{},
+		Mutex:            sync.Mutex{},
 	}
+	ss.current.Store(&snapshot{peers: make(map[peer.ID]*peerctx)})
+	for _, pid := range conf.Trusted {
+		ss.trusted[pid] = true
+	}
+	ss.routingTable = conf.RoutingTable
+	if ss.routingTable == nil {
+		rings := conf.Rings
+		if rings.LatencyEstimateFn == nil {
+			rings.LatencyEstimateFn = conf.LatencyEstimateFn
+		}
+		if rings.Logger.Module == "" {
+			rings.Logger = *logging.MustGetLogger("routingtable")
+		}
+		rings.LatencyProbFn = conf.LatencyProbeFn
+		ss.routingTable = routingtable.NewRingsRoutingTable(rings)
+	}
+
+	// Release the streams of peers that the routing table evicts.
+	if rings, ok := ss.routingTable.(routingtable.RingsRoutingTable); ok {
+		rings.OnEvict(ss.evicted)
+	}
+
+	// Watch for idle streams until explicitly shut down.
+	if conf.HeartbeatInterval > 0 || conf.IdleTimeout > 0 {
+		go ss.monitor()
+	}
+
+	return ss
 }
 
 func (ss *streamstore) Add(pid peer.ID, stream net.Stream, outbound bool) bool {
 	ss.Lock()
 	defer ss.Unlock()
 
-	ctx, exists := ss.peers[pid]
+	ctx, exists := ss.load().peers[pid]
+	if exists && ctx.outbound != outbound && ss.conf.ID != "" {
+		// Both peers paired with each other at once.  Keep the stream opened by
+		// the peer with the smaller identifier, so that both sides agree.
+		if ctx.outbound == (ss.conf.ID < pid) {
+			ss.Debug("Cannot add", pid, "to stream store: already paired")
+			return false
+		}
+	}
 	if exists {
 		ss.Debug("Removing", pid, "from stream store")
+		ss.modify(func(peers map[peer.ID]*peerctx) {
+			delete(peers, pid)
+		})
 		ctx.Close()
-		delete(ss.peers, pid)
+		ss.abandon(pid)
 	}
 
-	if outbound && ss.outboundSize() >= ss.OutboundCapacity() {
+	// Trusted peers take a reserved slot if there is one.
+	current := ss.load()
+	reserved := ss.trusted[pid] && (outbound && current.reservedOutbound < ss.conf.ReservedOutboundCapacity ||
+		!outbound && current.reservedInbound < ss.conf.ReservedInboundCapacity)
+
+	if !reserved && outbound && current.outbound >= ss.OutboundCapacity() && !ss.evict(pid, true) {
 		ss.Debug("Cannot add", pid, "to stream store: too many outbound connections")
 		return false
 	}
 
-	if !outbound && ss.inboundSize() >= ss.InboundCapacity() {
+	if !reserved && !outbound && current.inbound >= ss.InboundCapacity() && !ss.evict(pid, false) {
 		ss.Debug("Cannot add", pid, "to stream store: too many inbound connections")
 		return false
 	}
 
-	ctx = peerctx{
-		outbound: outbound,
-		queue:    make(chan transaction, ss.txQueueSize),
-		stream:   stream,
+	now := time.Now().UnixNano()
+	ctx = &peerctx{
+		outbound:  outbound,
+		reserved:  reserved,
+		queue:     newTxQueue(ss.txQueueSize),
+		stream:    stream,
+		added:     time.Now(),
+		control:   newTxQueue(ss.txQueueSize),
+		lastRead:  now,
+		lastWrite: now,
 	}
 
+	ctx.workers.Add(1)
 	go func() {
-		for {
-			select {
-			case tx, ok := <-ctx.queue:
-				if !ok {
-					return
-				}
-				ss.Debug("Processing transaction for", pid)
-				err := tx.query(pid, ctx.stream)
-				ss.Debug("Recording result for", pid)
-				tx.Lock()
-				tx.result[pid] <- err
-				tx.Unlock()
-			}
-		}
+		defer ctx.workers.Done()
+		ss.work(pid, ctx, ctx.queue, ctx.stream)
 	}()
 	ss.Debug("Adding stream", pid, "to stream store")
-	ss.peers[pid] = ctx
+	ss.modify(func(peers map[peer.ID]*peerctx) {
+		peers[pid] = ctx
+	})
+	// The routing table probes the latency of the peer in the background, so
+	// this does not block on the network.
 	ss.routingTable.Add(pid)
 	return true
 }
@@ -157,71 +458,87 @@ func (ss *streamstore) Add(pid peer.ID, stream net.Stream, outbound bool) bool {
 func (ss *streamstore) Apply(f func(peer.ID, io.Writer) error, exclude peer.IDSlice) map[peer.ID]chan error {
 	// Apply the function to Sqrt(N) streams where N is the total capacity of
 	// the stream store.
-	pids := ss.routingTable.Recommend(int(math.Sqrt(float64(ss.InboundCapacity()+ss.OutboundCapacity()))), exclude)
-	return ss.apply(f, exclude, pids)
+	return ss.ApplyN(f, int(math.Sqrt(float64(ss.InboundCapacity()+ss.OutboundCapacity()))), exclude)
+}
+
+func (ss *streamstore) ApplyN(f func(peer.ID, io.Writer) error, count int, exclude peer.IDSlice) map[peer.ID]chan error {
+	pids := ss.routingTable.Recommend(count, exclude)
+	return ss.apply(newTransaction(context.Background(), f), exclude, pids)
+}
+
+func (ss *streamstore) ApplyTo(f func(peer.ID, io.Writer) error, peers peer.IDSlice) map[peer.ID]chan error {
+	return ss.apply(newTransaction(context.Background(), f), nil, peers)
 }
 
 func (ss *streamstore) ApplyAll(f func(peer.ID, io.Writer) error, exclude peer.IDSlice) map[peer.ID]chan error {
 	var pids []peer.ID
-	for pid := range ss.peers {
+	for pid := range ss.load().peers {
 		pids = append(pids, pid)
 	}
-	return ss.apply(f, exclude, pids)
+	return ss.apply(newTransaction(context.Background(), f), exclude, pids)
 }
 
-func (ss *streamstore) apply(f func(peer.ID, io.Writer) error, exclude peer.IDSlice, peers peer.IDSlice) map[peer.ID]chan error {
-	ss.Lock()
-	defer ss.Unlock()
-	tx := transaction{
-		f,
-		make(map[peer.ID]chan error),
-		&sync.Mutex{},
-	}
-	var group sync.WaitGroup
+func (ss *streamstore) apply(tx transaction, exclude peer.IDSlice, peers peer.IDSlice) map[peer.ID]chan error {
+	// Prepare every result before queueing the transaction, since the workers
+	// read the results concurrently.
+	current := ss.load()
+	targets := make(map[peer.ID]*peerctx)
 	for _, pid := range peers {
-		pid := pid
-		ctx := ss.peers[pid]
+		ctx, exists := current.peers[pid]
+		if !exists {
+			continue
+		}
 		i := sort.Search(len(exclude), func(i int) bool {
 			return exclude[i] >= pid
 		})
 		if i < len(exclude) && exclude[i] == pid {
 			continue
 		}
-		group.Add(1)
-		go func() {
-			defer group.Done()
-			ss.Debug("Preparing result for", pid)
+		targets[pid] = ctx
+		tx.result[pid] = make(chan error, 1)
+	}
+	for pid, ctx := range targets {
+		ss.Debug("Queueing transaction for", pid)
+		queue, err := ctx.enqueue(tx)
+		if err == nil {
+			tx.queues[pid] = queue
+		} else {
+			ss.Debug("Cannot queue transaction for", pid, err)
 			tx.Lock()
-			tx.result[pid] = make(chan error, 1)
+			tx.outcomes[pid] = Outcome{Err: err}
+			tx.result[pid] <- err
 			tx.Unlock()
-			ss.Debug("Queueing transaction for", pid)
-			select {
-			case ctx.queue <- tx:
-			default:
-				ss.Debug("Cannot queue transaction for", pid)
-				tx.Lock()
-				tx.result[pid] <- errors.New("transaction queue is full")
-				tx.Unlock()
-			}
-		}()
-	}
-	group.Wait()
+		}
+	}
 	return tx.result
 }
 
 func (ss *streamstore) InboundCapacity() int {
-	return ss.inboundCapacity
+	return int(atomic.LoadInt64(&ss.inboundCapacity))
 }
 
 func (ss *streamstore) OutboundCapacity() int {
-	return ss.outboundCapacity
+	return int(atomic.LoadInt64(&ss.outboundCapacity))
+}
+
+func (ss *streamstore) SetCapacity(inbound, outbound int) error {
+	if inbound <= 0 || outbound <= 0 {
+		return fmt.Errorf("invalid capacity: %d inbound, %d outbound", inbound, outbound)
+	}
+
+	ss.Lock()
+	defer ss.Unlock()
+
+	atomic.StoreInt64(&ss.inboundCapacity, int64(inbound))
+	atomic.StoreInt64(&ss.outboundCapacity, int64(outbound))
+	ss.trim(false, inbound)
+	ss.trim(true, outbound)
+	return nil
 }
 
 func (ss *streamstore) InboundPeers() []peer.ID {
-	ss.RLock()
-	defer ss.RUnlock()
 	var peers []peer.ID
-	for pid, ctx := range ss.peers {
+	for pid, ctx := range ss.load().peers {
 		if !ctx.outbound {
 			peers = append(peers, pid)
 		}
@@ -230,10 +547,8 @@ func (ss *streamstore) InboundPeers() []peer.ID {
 }
 
 func (ss *streamstore) OutboundPeers() []peer.ID {
-	ss.RLock()
-	defer ss.RUnlock()
 	var peers []peer.ID
-	for pid, ctx := range ss.peers {
+	for pid, ctx := range ss.load().peers {
 		if ctx.outbound {
 			peers = append(peers, pid)
 		}
@@ -245,57 +560,95 @@ func (ss *streamstore) Purge() {
 	ss.Lock()
 	defer ss.Unlock()
 
-	for pid, ctx := range ss.peers {
+	peers := ss.load().peers
+	ss.current.Store(&snapshot{peers: make(map[peer.ID]*peerctx)})
+	for pid, ctx := range peers {
 		ss.Debug("Removing stream", pid, "from stream store")
 		ctx.Close()
+		ss.abandon(pid)
 	}
-
-	ss.peers = make(map[peer.ID]peerctx)
 }
 
 func (ss *streamstore) Remove(pid peer.ID) {
 	ss.Lock()
 	defer ss.Unlock()
 
-	if ctx, exists := ss.peers[pid]; exists {
-		ss.Debug("Removing stream", pid, "from stream store")
-		ctx.Close()
-		delete(ss.peers, pid)
+	if _, exists := ss.load().peers[pid]; exists {
+		ss.drop(pid)
+	} else {
+		ss.routingTable.Remove(pid)
 	}
+}
 
-	ss.routingTable.Remove(pid)
+// Release the stream of a peer that the routing table evicted, unless the peer
+// is trusted or was added again in the meantime, and let the caller find
+// another.
+func (ss *streamstore) evicted(pid peer.ID) {
+	ss.Lock()
+	var ctx *peerctx
+	if !ss.trusted[pid] && !ss.routingTable.Find(pid) {
+		ctx = ss.unpair(pid)
+	}
+	ss.Unlock()
+	if ctx == nil {
+		return
+	}
+	ctx.Close()
+	if ss.conf.IdleFn != nil {
+		ss.conf.IdleFn(pid)
+	}
 }
 
-func (ss *streamstore) InboundSize() int {
-	ss.RLock()
-	defer ss.RUnlock()
+func (ss *streamstore) RemoveStream(pid peer.ID, stream net.Stream) {
+	ss.Lock()
+	defer ss.Unlock()
 
-	return ss.inboundSize()
+	ctx, exists := ss.load().peers[pid]
+	if !exists {
+		return
+	}
+	ctx.Lock()
+	match := ctx.stream == stream || ctx.controlStream == stream
+	ctx.Unlock()
+	if match {
+		ss.drop(pid)
+	}
 }
 
-func (ss *streamstore) inboundSize() int {
-	var count int
-	for _, ctx := range ss.peers {
-		if !ctx.outbound {
-			count++
-		}
-	}
-	return count
+func (ss *streamstore) InboundSize() int {
+	return ss.load().inbound
 }
 
 func (ss *streamstore) OutboundSize() int {
-	ss.RLock()
-	defer ss.RUnlock()
+	return ss.load().outbound
+}
 
-	return ss.outboundSize()
+func (ss *streamstore) ReservedSize() (int, int) {
+	current := ss.load()
+	return current.reservedInbound, current.reservedOutbound
 }
 
-func (ss *streamstore) outboundSize() int {
-	var count int
-	for _, ctx := range ss.peers {
-		if ctx.outbound {
-			count++
-		}
+func (ss *streamstore) Trusted(pid peer.ID) bool {
+	return ss.trusted[pid]
+}
+
+func (ss *streamstore) Touch(pid peer.ID) {
+	if ctx, exists := ss.load().peers[pid]; exists {
+		atomic.StoreInt64(&ctx.lastRead, time.Now().UnixNano())
+	}
+}
+
+func (ss *streamstore) Rings() []routingtable.RingInfo {
+	if rings, ok := ss.routingTable.(routingtable.RingsRoutingTable); ok {
+		return rings.Rings()
+	}
+	return nil
+}
+
+func (ss *streamstore) Shutdown() {
+	close(ss.shutdown)
+	ss.Purge()
+	if ss.conf.RoutingTable == nil {
+		ss.routingTable.Shutdown()
 	}
-	return count
 }
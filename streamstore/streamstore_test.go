@@ -9,11 +9,15 @@
 package streamstore
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"io"
 	mathrand "math/rand"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -26,6 +30,9 @@ import (
 	"gx/ipfs/QmefgzMbKZYsmHFkLqxgaTBG9ypeEjrdWRD5WXH4j1cWDL/go-libp2p/p2p/host/basic"
 
 	"github.com/enzoh/go-logging"
+
+	"github.com/dfinity/go-revolver/routingtable"
+	"github.com/dfinity/go-revolver/util"
 )
 
 const QUEUE_SIZE = 10
@@ -215,3 +222,1010 @@ func TestStreamstore(test *testing.T) {
 	}
 
 }
+
+// Show that the stream store sends heartbeats on idle streams and removes
+// peers that go silent.
+func TestHeartbeat(test *testing.T) {
+
+	// Create a client that sends heartbeats and watches for silent peers.
+	client1 := new(test, 34567)
+	defer client1.host.Close()
+	var heartbeat [32]byte
+	silent := make(chan peer.ID, 1)
+	conf := NewDefaultConfig(randomProbe)
+	conf.Heartbeat = heartbeat[:]
+	conf.HeartbeatInterval = 50 * time.Millisecond
+	conf.IdleTimeout = 500 * time.Millisecond
+	conf.IdleFn = func(pid peer.ID) {
+		silent <- pid
+	}
+	client1.streamstore = NewWithConfig(conf)
+	defer client1.streamstore.Shutdown()
+
+	// Create a target peer that never writes.
+	client2 := new(test, 45678)
+	defer client2.host.Close()
+
+	// Add the target peer to the peer store of the client.
+	client1.peerstore.AddAddr(
+		client2.id,
+		client2.address,
+		peerstore.TempAddrTTL,
+	)
+
+	// Connect to the target peer.
+	stream, err := client1.host.NewStream(client1.ctx, client2.id, "/test")
+	if err != nil {
+		test.Fatal(err)
+	}
+	if !client1.streamstore.Add(client2.id, stream, true) {
+		test.Fatal("Cannot add", client2.id, "to stream store")
+	}
+
+	// Verify that the target peer receives a heartbeat.
+	select {
+	case artifact := <-client2.queue:
+		if artifact != heartbeat {
+			test.Fatal("Corrupt heartbeat!")
+		}
+	case <-time.After(time.Second):
+		test.Fatal("Missing heartbeat!")
+	}
+
+	// Verify that the client removes the target peer once it goes silent.
+	select {
+	case pid := <-silent:
+		if pid != client2.id {
+			test.Fatal("Wrong peer!", pid)
+		}
+	case <-time.After(time.Second):
+		test.Fatal("Peer was not removed!")
+	}
+	if client1.streamstore.OutboundSize() != 0 {
+		test.Fatal("Stream store is not empty!")
+	}
+
+}
+
+// A stream that does nothing.
+type nopStream struct {
+	net.Stream
+}
+
+func (nopStream) Close() error {
+	return nil
+}
+
+// Create a random peer identity.
+func randomPeer(test *testing.T) peer.ID {
+	_, pubkey, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		test.Fatal(err)
+	}
+	pid, err := peer.IDFromPublicKey(pubkey)
+	if err != nil {
+		test.Fatal(err)
+	}
+	return pid
+}
+
+// Show that a full stream store evicts its worst-scoring stream in favour of
+// a better candidate, but not more often than the eviction interval allows.
+func TestEviction(test *testing.T) {
+
+	conf := NewDefaultConfig(randomProbe)
+	conf.InboundCapacity = 2
+	conf.EvictionGracePeriod = 0
+	conf.EvictionInterval = time.Hour
+	ss := NewWithConfig(conf)
+	defer ss.Shutdown()
+
+	// Fill the stream store with a good peer and a bad peer.
+	good := randomPeer(test)
+	bad := randomPeer(test)
+	if !ss.Add(good, nopStream{}, false) || !ss.Add(bad, nopStream{}, false) {
+		test.Fatal("Cannot fill stream store!")
+	}
+	for i := 0; i < 8; i++ {
+		ss.Observe(good, routingtable.Fresh)
+		ss.Observe(bad, routingtable.Stale)
+	}
+	ss.Observe(bad, routingtable.Invalid)
+	if ss.Score(bad) >= ss.Score(good) {
+		test.Fatal("Bad peer outscores good peer!")
+	}
+
+	// Verify that a new peer replaces the bad peer.
+	if !ss.Add(randomPeer(test), nopStream{}, false) {
+		test.Fatal("Cannot evict bad peer!")
+	}
+	for _, pid := range ss.InboundPeers() {
+		if pid == bad {
+			test.Fatal("Bad peer was not evicted!")
+		}
+	}
+
+	// Verify that another new peer must wait for the next interval.
+	if ss.Add(randomPeer(test), nopStream{}, false) {
+		test.Fatal("Eviction was not rate limited!")
+	}
+	if ss.InboundSize() != 2 {
+		test.Fatal("Wrong number of streams!", ss.InboundSize())
+	}
+
+}
+
+// A stream that records what is written to it.
+type bufferStream struct {
+	net.Stream
+	buffer bytes.Buffer
+	sync.Mutex
+}
+
+func (stream *bufferStream) Write(data []byte) (int, error) {
+	stream.Lock()
+	defer stream.Unlock()
+	return stream.buffer.Write(data)
+}
+
+func (stream *bufferStream) Close() error {
+	return nil
+}
+
+// Show that a context-scoped transaction reports its outcome, and that a
+// cancelled transaction never touches the stream.
+func TestApplyContext(test *testing.T) {
+
+	ss := NewWithConfig(NewDefaultConfig(randomProbe))
+	defer ss.Shutdown()
+
+	pid := randomPeer(test)
+	stream := &bufferStream{}
+	if !ss.Add(pid, stream, false) {
+		test.Fatal("Cannot add", pid, "to stream store")
+	}
+	write := func(_ peer.ID, writer io.Writer) error {
+		_, err := writer.Write([]byte("hello"))
+		return err
+	}
+
+	// Verify the outcome of a successful transaction.
+	result := ss.ApplyContext(context.Background(), write, nil)
+	outcome, exists := result[pid]
+	if !exists || outcome.Err != nil || outcome.Bytes != 5 {
+		test.Fatal("Wrong outcome!", outcome)
+	}
+
+	// Verify the outcome of a cancelled transaction.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result = ss.ApplyContext(ctx, write, nil)
+	outcome, exists = result[pid]
+	if !exists || outcome.Err != context.Canceled || outcome.Bytes != 0 {
+		test.Fatal("Wrong outcome!", outcome)
+	}
+
+	// Verify that the cancelled transaction was dropped from the queue.
+	ss.ApplyContext(context.Background(), write, nil)
+	stream.Lock()
+	defer stream.Unlock()
+	if stream.buffer.String() != "hellohello" {
+		test.Fatal("Corrupt stream!", stream.buffer.String())
+	}
+
+}
+
+// Show that a cancelled transaction leaves the queue, and that a transaction
+// that already started reports its own outcome.
+func TestApplyCancelled(test *testing.T) {
+
+	conf := NewDefaultConfig(randomProbe)
+	conf.QueueSize = 1
+	ss := NewWithConfig(conf)
+	defer ss.Shutdown()
+
+	pid := randomPeer(test)
+	if !ss.Add(pid, &bufferStream{}, false) {
+		test.Fatal("Cannot add", pid, "to stream store")
+	}
+
+	// Start a transaction that writes and then waits for its context.
+	started := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan Result)
+	go func() {
+		done <- ss.ApplyContext(ctx, func(_ peer.ID, writer io.Writer) error {
+			writer.Write([]byte("a"))
+			close(started)
+			<-ctx.Done()
+			_, err := writer.Write([]byte("b"))
+			return err
+		}, nil)
+	}()
+	<-started
+
+	// Fill the queue with a transaction that expires before it starts.
+	expiring, stop := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer stop()
+	write := func(_ peer.ID, writer io.Writer) error {
+		_, err := writer.Write([]byte("c"))
+		return err
+	}
+	result := ss.ApplyContext(expiring, write, nil)
+	if outcome := result[pid]; outcome.Err != context.DeadlineExceeded || outcome.Bytes != 0 {
+		test.Fatal("Wrong outcome!", outcome)
+	}
+
+	// Verify that the queue has room again.
+	results := ss.ApplyTo(write, peer.IDSlice{pid})
+	select {
+	case err := <-results[pid]:
+		test.Fatal("Transaction was not queued!", err)
+	default:
+	}
+
+	// Verify that the started transaction reports what it wrote.
+	cancel()
+	outcome := (<-done)[pid]
+	if outcome.Err != context.Canceled || outcome.Bytes != 1 {
+		test.Fatal("Wrong outcome!", outcome)
+	}
+	if err := <-results[pid]; err != nil {
+		test.Fatal(err)
+	}
+
+}
+
+// One end of an in-memory stream.
+type pipeStream struct {
+	net.Stream
+	reader *io.PipeReader
+	writer *io.PipeWriter
+}
+
+func (stream *pipeStream) Read(data []byte) (int, error) {
+	return stream.reader.Read(data)
+}
+
+func (stream *pipeStream) Write(data []byte) (int, error) {
+	return stream.writer.Write(data)
+}
+
+func (stream *pipeStream) Close() error {
+	return nil
+}
+
+// Create both ends of an in-memory stream.
+func newPipeStreams() (*pipeStream, *pipeStream) {
+	reader1, writer1 := io.Pipe()
+	reader2, writer2 := io.Pipe()
+	return &pipeStream{reader: reader1, writer: writer2}, &pipeStream{reader: reader2, writer: writer1}
+}
+
+// Serve requests and responses from a stream until it fails.
+func serve(ss Streamstore, pid peer.ID, stream net.Stream) {
+	var frame [1]byte
+	for {
+		_, err := io.ReadFull(stream, frame[:])
+		if err != nil {
+			return
+		}
+		err = ss.Serve(pid, frame[0], stream)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Show that a peer can answer a request over its paired stream.
+func TestRequest(test *testing.T) {
+
+	// Create a stream store that sends requests.
+	conf1 := NewDefaultConfig(randomProbe)
+	conf1.RequestFrame = 0x05
+	conf1.ResponseFrame = 0x06
+	ss1 := NewWithConfig(conf1)
+	defer ss1.Shutdown()
+
+	// Create a stream store that answers requests.
+	conf2 := conf1
+	conf2.RequestFn = func(_ peer.ID, request []byte) ([]byte, error) {
+		return bytes.ToUpper(request), nil
+	}
+	ss2 := NewWithConfig(conf2)
+	defer ss2.Shutdown()
+
+	// Pair the stream stores.
+	pid1 := randomPeer(test)
+	pid2 := randomPeer(test)
+	stream1, stream2 := newPipeStreams()
+	if !ss1.Add(pid2, stream1, true) || !ss2.Add(pid1, stream2, false) {
+		test.Fatal("Cannot pair stream stores!")
+	}
+	go serve(ss1, pid2, stream1)
+	go serve(ss2, pid1, stream2)
+
+	// Verify that the response matches the request.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	response, err := ss1.Request(ctx, pid2, []byte("hello"))
+	if err != nil {
+		test.Fatal(err)
+	}
+	if string(response) != "HELLO" {
+		test.Fatal("Wrong response!", string(response))
+	}
+
+	// Verify that requests to unknown peers fail.
+	_, err = ss1.Request(ctx, randomPeer(test), []byte("hello"))
+	if err != ErrNotPaired {
+		test.Fatal("Wrong error!", err)
+	}
+
+}
+
+// Show that failed and excess requests are answered with an error.
+func TestRequestError(test *testing.T) {
+
+	// Create a stream store that sends requests.
+	conf1 := NewDefaultConfig(randomProbe)
+	conf1.RequestFrame = 0x05
+	conf1.ResponseFrame = 0x06
+	conf1.ErrorFrame = 0x15
+	ss1 := NewWithConfig(conf1)
+	defer ss1.Shutdown()
+
+	// Create a stream store that answers one request at a time, and fails
+	// every request but the first.
+	started := make(chan struct{})
+	release := make(chan struct{})
+	conf2 := conf1
+	conf2.RequestWorkers = 1
+	conf2.RequestFn = func(_ peer.ID, request []byte) ([]byte, error) {
+		if string(request) == "block" {
+			close(started)
+			<-release
+			return request, nil
+		}
+		return nil, errors.New("bad request")
+	}
+	ss2 := NewWithConfig(conf2)
+	defer ss2.Shutdown()
+
+	// Pair the stream stores.
+	pid1 := randomPeer(test)
+	pid2 := randomPeer(test)
+	stream1, stream2 := newPipeStreams()
+	if !ss1.Add(pid2, stream1, true) || !ss2.Add(pid1, stream2, false) {
+		test.Fatal("Cannot pair stream stores!")
+	}
+	go serve(ss1, pid2, stream1)
+	go serve(ss2, pid1, stream2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// Verify that a failed request reports the error of the peer.
+	_, err := ss1.Request(ctx, pid2, []byte("hello"))
+	if err == nil || !strings.Contains(err.Error(), "bad request") {
+		test.Fatal("Wrong error!", err)
+	}
+
+	// Verify that a request is refused while the only worker is busy.
+	blocked := make(chan error, 1)
+	go func() {
+		_, err := ss1.Request(ctx, pid2, []byte("block"))
+		blocked <- err
+	}()
+	<-started
+	_, err = ss1.Request(ctx, pid2, []byte("hello"))
+	if err == nil || !strings.Contains(err.Error(), "too many requests") {
+		test.Fatal("Wrong error!", err)
+	}
+	close(release)
+	if err := <-blocked; err != nil {
+		test.Fatal(err)
+	}
+
+}
+
+// Show that simultaneous pairing keeps the stream opened by the peer with the
+// smaller identifier.
+func TestSimultaneousPairing(test *testing.T) {
+
+	conf := NewDefaultConfig(randomProbe)
+	conf.ID = peer.ID("a")
+	ss := NewWithConfig(conf)
+	defer ss.Shutdown()
+	pid := peer.ID("b")
+
+	// Verify that our outbound stream replaces the inbound stream.
+	inbound := &bufferStream{}
+	outbound := &bufferStream{}
+	if !ss.Add(pid, inbound, false) || !ss.Add(pid, outbound, true) {
+		test.Fatal("Cannot add", pid, "to stream store")
+	}
+	if ss.InboundSize() != 0 || ss.OutboundSize() != 1 {
+		test.Fatal("Wrong number of streams!", ss.InboundSize(), ss.OutboundSize())
+	}
+
+	// Verify that another inbound stream does not replace it.
+	if ss.Add(pid, &bufferStream{}, false) {
+		test.Fatal("Inbound stream replaced outbound stream!")
+	}
+
+	// Verify that removing the replaced stream keeps the outbound stream.
+	ss.RemoveStream(pid, inbound)
+	if ss.OutboundSize() != 1 {
+		test.Fatal("Outbound stream was removed!")
+	}
+	ss.RemoveStream(pid, outbound)
+	if ss.OutboundSize() != 0 {
+		test.Fatal("Outbound stream was not removed!")
+	}
+
+}
+
+// A stream that discards what is written to it.
+type discardStream struct {
+	net.Stream
+}
+
+func (discardStream) Write(data []byte) (int, error) {
+	return len(data), nil
+}
+
+func (discardStream) Close() error {
+	return nil
+}
+
+// Create a stream store with the given number of peers.
+func newBenchmarkStreamstore(b *testing.B, n int) Streamstore {
+	logging.SetLevel(logging.WARNING, "streamstore")
+	conf := NewDefaultConfig(randomProbe)
+	conf.InboundCapacity = n
+	conf.OutboundCapacity = n
+	conf.EvictionInterval = 0
+	ss := NewWithConfig(conf)
+	for i := 0; i < n; i++ {
+		pid := peer.ID(fmt.Sprintf("peer-%d", i))
+		if !ss.Add(pid, discardStream{}, i%2 == 0) {
+			b.Fatal("Cannot add", pid, "to stream store")
+		}
+	}
+	return ss
+}
+
+// Measure the cost of applying a function to every stream.
+func benchmarkApplyAll(b *testing.B, n int) {
+	ss := newBenchmarkStreamstore(b, n)
+	defer ss.Shutdown()
+	data := make([]byte, 32)
+	write := func(_ peer.ID, writer io.Writer) error {
+		_, err := writer.Write(data)
+		return err
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			for _, result := range ss.ApplyAll(write, nil) {
+				<-result
+			}
+		}
+	})
+}
+
+func BenchmarkApplyAll16(b *testing.B) {
+	benchmarkApplyAll(b, 16)
+}
+
+func BenchmarkApplyAll256(b *testing.B) {
+	benchmarkApplyAll(b, 256)
+}
+
+// Measure the cost of applying a function while peers come and go.
+func BenchmarkApplyWithChurn(b *testing.B) {
+	ss := newBenchmarkStreamstore(b, 64)
+	defer ss.Shutdown()
+	write := func(_ peer.ID, writer io.Writer) error {
+		_, err := writer.Write([]byte{0})
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+				pid := peer.ID(fmt.Sprintf("peer-%d", i%64))
+				ss.Remove(pid)
+				ss.Add(pid, discardStream{}, i%2 == 0)
+			}
+		}
+	}()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			for _, result := range ss.Apply(write, nil) {
+				<-result
+			}
+		}
+	})
+}
+
+// A stream whose writes block until it is released.
+type blockingStream struct {
+	net.Stream
+	release chan struct{}
+}
+
+func (stream blockingStream) Write(data []byte) (int, error) {
+	<-stream.release
+	return len(data), nil
+}
+
+func (blockingStream) Close() error {
+	return nil
+}
+
+// Show that the control lane does not queue behind a bulk transfer.
+func TestControlLane(test *testing.T) {
+
+	ss := NewWithConfig(NewDefaultConfig(randomProbe))
+	defer ss.Shutdown()
+
+	// Pair with a peer whose bulk stream is stuck.
+	pid := randomPeer(test)
+	bulk := blockingStream{release: make(chan struct{})}
+	defer close(bulk.release)
+	control := &bufferStream{}
+	if !ss.Add(pid, bulk, true) || !ss.AddControl(pid, control) {
+		test.Fatal("Cannot add", pid, "to stream store")
+	}
+	write := func(_ peer.ID, writer io.Writer) error {
+		_, err := writer.Write([]byte("hello"))
+		return err
+	}
+
+	// Start a bulk transfer.
+	bulkResults := ss.ApplyTo(write, peer.IDSlice{pid})
+
+	// Verify that a control message gets through in the meantime.
+	select {
+	case err := <-ss.ApplyControlTo(write, peer.IDSlice{pid})[pid]:
+		if err != nil {
+			test.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		test.Fatal("Control message is stuck behind bulk transfer!")
+	}
+	select {
+	case <-bulkResults[pid]:
+		test.Fatal("Bulk transfer is not stuck!")
+	default:
+	}
+
+}
+
+// Show that shrinking the stream store trims the lowest-scoring streams after
+// their queued transactions are done, and that growth takes effect at once.
+func TestSetCapacity(test *testing.T) {
+
+	conf := NewDefaultConfig(randomProbe)
+	conf.InboundCapacity = 2
+	conf.EvictionInterval = 0
+	ss := NewWithConfig(conf)
+	defer ss.Shutdown()
+
+	// Fill the stream store with a good peer and a bad peer, whose stream is
+	// busy.
+	good := randomPeer(test)
+	bad := randomPeer(test)
+	busy := blockingStream{release: make(chan struct{})}
+	if !ss.Add(good, &bufferStream{}, false) || !ss.Add(bad, busy, false) {
+		test.Fatal("Cannot fill stream store!")
+	}
+	for i := 0; i < 8; i++ {
+		ss.Observe(good, routingtable.Fresh)
+		ss.Observe(bad, routingtable.Stale)
+	}
+	results := ss.ApplyTo(func(_ peer.ID, writer io.Writer) error {
+		_, err := writer.Write([]byte("hello"))
+		return err
+	}, peer.IDSlice{bad})
+
+	// Verify that shrinking removes the bad peer.
+	err := ss.SetCapacity(1, 1)
+	if err != nil {
+		test.Fatal(err)
+	}
+	peers := ss.InboundPeers()
+	if len(peers) != 1 || peers[0] != good {
+		test.Fatal("Wrong peers!", peers)
+	}
+
+	// Verify that the queued transaction of the bad peer still completes.
+	close(busy.release)
+	select {
+	case err := <-results[bad]:
+		if err != nil {
+			test.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		test.Fatal("Queued transaction was lost!")
+	}
+
+	// Verify that growth takes effect at once.
+	err = ss.SetCapacity(2, 1)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if !ss.Add(randomPeer(test), &bufferStream{}, false) {
+		test.Fatal("Cannot add peer after growth!")
+	}
+
+	// Verify that invalid capacities are rejected.
+	if ss.SetCapacity(0, 1) == nil {
+		test.Fatal("Invalid capacity was accepted!")
+	}
+
+}
+
+// A stream that blocks writes until released and records when it is closed.
+type closingStream struct {
+	net.Stream
+	release chan struct{}
+	closed  chan struct{}
+	once    *sync.Once
+}
+
+func newClosingStream() closingStream {
+	return closingStream{
+		release: make(chan struct{}),
+		closed:  make(chan struct{}),
+		once:    &sync.Once{},
+	}
+}
+
+func (stream closingStream) Write(data []byte) (int, error) {
+	<-stream.release
+	return len(data), nil
+}
+
+func (stream closingStream) Close() error {
+	stream.once.Do(func() {
+		close(stream.closed)
+	})
+	return nil
+}
+
+// Show that a trimmed peer keeps its streams until both lanes are done.
+func TestRetire(test *testing.T) {
+
+	conf := NewDefaultConfig(randomProbe)
+	conf.InboundCapacity = 2
+	conf.EvictionInterval = 0
+	ss := NewWithConfig(conf)
+	defer ss.Shutdown()
+
+	// Fill the stream store with a good peer and a bad peer, whose control
+	// stream is busy.
+	good := randomPeer(test)
+	bad := randomPeer(test)
+	bulk := newClosingStream()
+	close(bulk.release)
+	control := newClosingStream()
+	if !ss.Add(good, &bufferStream{}, false) || !ss.Add(bad, bulk, false) || !ss.AddControl(bad, control) {
+		test.Fatal("Cannot fill stream store!")
+	}
+	for i := 0; i < 8; i++ {
+		ss.Observe(good, routingtable.Fresh)
+		ss.Observe(bad, routingtable.Stale)
+	}
+	results := ss.ApplyControlTo(func(_ peer.ID, writer io.Writer) error {
+		_, err := writer.Write([]byte("hello"))
+		return err
+	}, peer.IDSlice{bad})
+
+	// Verify that shrinking leaves the streams open while the control lane
+	// is busy.
+	err := ss.SetCapacity(1, 1)
+	if err != nil {
+		test.Fatal(err)
+	}
+	select {
+	case <-bulk.closed:
+		test.Fatal("Bulk stream was closed before the control lane drained!")
+	case <-control.closed:
+		test.Fatal("Control stream was closed before the control lane drained!")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Verify that both streams are closed once the control lane drains.
+	close(control.release)
+	if err := <-results[bad]; err != nil {
+		test.Fatal(err)
+	}
+	for _, closed := range []chan struct{}{bulk.closed, control.closed} {
+		select {
+		case <-closed:
+		case <-time.After(time.Second):
+			test.Fatal("Stream was not closed!")
+		}
+	}
+
+}
+
+// Show that untrusted peers cannot take the slots reserved for trusted peers.
+func TestReservedSlots(test *testing.T) {
+
+	trusted := randomPeer(test)
+	conf := NewDefaultConfig(randomProbe)
+	conf.InboundCapacity = 1
+	conf.EvictionInterval = 0
+	conf.Trusted = []peer.ID{trusted}
+	conf.ReservedInboundCapacity = 1
+	ss := NewWithConfig(conf)
+	defer ss.Shutdown()
+
+	// Fill the unreserved slots.
+	if !ss.Add(randomPeer(test), &bufferStream{}, false) {
+		test.Fatal("Cannot fill stream store!")
+	}
+
+	// Verify that an untrusted peer cannot take the reserved slot.
+	if ss.Add(randomPeer(test), &bufferStream{}, false) {
+		test.Fatal("Untrusted peer took a reserved slot!")
+	}
+
+	// Verify that the trusted peer can.
+	if !ss.Add(trusted, &bufferStream{}, false) {
+		test.Fatal("Trusted peer was locked out!")
+	}
+	inbound, outbound := ss.ReservedSize()
+	if inbound != 1 || outbound != 0 || ss.InboundSize() != 1 {
+		test.Fatal("Wrong number of streams!", inbound, outbound, ss.InboundSize())
+	}
+
+}
+
+// Show that the default routing table follows the rings config.
+func TestRingsConfig(test *testing.T) {
+
+	conf := NewDefaultConfig(randomProbe)
+	conf.Rings.RingsCount = 3
+	conf.Rings.BaseLatency = time.Millisecond
+	conf.Rings.LatencyGrowthFactor = 4
+	ss := NewWithConfig(conf)
+	defer ss.Shutdown()
+
+	// Verify the latency ranges of the rings.
+	rings := ss.Rings()
+	if len(rings) != 3 {
+		test.Fatal("Wrong number of rings!", len(rings))
+	}
+	expected := []time.Duration{0, time.Millisecond, 4 * time.Millisecond}
+	for i, ring := range rings {
+		if ring.MinLatency != expected[i] {
+			test.Fatal("Wrong latency range!", i, ring.MinLatency)
+		}
+	}
+
+}
+
+// Show that the stream store uses a given routing table and leaves it to the
+// caller to shut it down.
+func TestSharedRoutingTable(test *testing.T) {
+
+	table := routingtable.NewRingsRoutingTable(routingtable.NewDefaultRingsConfig(randomProbe))
+	defer table.Shutdown()
+	conf := NewDefaultConfig(randomProbe)
+	conf.RoutingTable = table
+	ss := NewWithConfig(conf)
+
+	// Verify that peers added to the stream store appear in the table.
+	pid := randomPeer(test)
+	if !ss.Add(pid, &bufferStream{}, false) {
+		test.Fatal("Cannot add", pid, "to stream store")
+	}
+	if !table.Find(pid) {
+		test.Fatal("Peer is missing from the shared table!")
+	}
+
+	// Verify that the table outlives the stream store, since shutting it
+	// down twice would panic.
+	ss.Shutdown()
+	table.Add(randomPeer(test))
+
+}
+
+// Show that a peer that the routing table evicts loses its stream.
+func TestEvictedByRoutingTable(test *testing.T) {
+
+	idle := make(chan peer.ID, 1)
+	conf := NewDefaultConfig(randomProbe)
+	conf.Rings.MaxFailures = 1
+	conf.IdleFn = func(pid peer.ID) {
+		idle <- pid
+	}
+	ss := NewWithConfig(conf)
+	defer ss.Shutdown()
+
+	pid := randomPeer(test)
+	stream := newClosingStream()
+	close(stream.release)
+	if !ss.Add(pid, stream, false) {
+		test.Fatal("Cannot add", pid, "to stream store")
+	}
+
+	// Verify that the stream is closed once the peer is evicted, and that the
+	// caller is asked to find another.
+	ss.Observe(pid, routingtable.Timeout)
+	select {
+	case <-stream.closed:
+	case <-time.After(time.Second):
+		test.Fatal("Stream of evicted peer was not closed!")
+	}
+	select {
+	case got := <-idle:
+		if got != pid {
+			test.Fatal("Wrong peer!", got)
+		}
+	case <-time.After(time.Second):
+		test.Fatal("Idle function was not called!")
+	}
+	if ss.InboundSize() != 0 {
+		test.Fatal("Evicted peer is still paired!")
+	}
+
+}
+
+// Show that a transaction that the caller cancels mid-write is not held
+// against the peer.
+func TestCancelledWriteKeepsPeer(test *testing.T) {
+
+	conf := NewDefaultConfig(randomProbe)
+	conf.Rings.MaxFailures = 1
+	ss := NewWithConfig(conf)
+	defer ss.Shutdown()
+
+	pid := randomPeer(test)
+	if !ss.Add(pid, &bufferStream{}, false) {
+		test.Fatal("Cannot add", pid, "to stream store")
+	}
+
+	// Cancel the transaction while it runs.
+	ctx, cancel := context.WithCancel(context.Background())
+	result := ss.ApplyContext(ctx, func(_ peer.ID, writer io.Writer) error {
+		cancel()
+		_, err := writer.Write([]byte("hello"))
+		return err
+	}, nil)
+	if outcome := result[pid]; outcome.Err != context.Canceled {
+		test.Fatal("Wrong outcome!", outcome)
+	}
+
+	// Verify that the peer is neither evicted nor unpaired.
+	time.Sleep(50 * time.Millisecond)
+	if ss.InboundSize() != 1 {
+		test.Fatal("Peer was evicted for a cancelled transaction!")
+	}
+
+}
+
+// Show that a transaction that fails on its own is not held against the peer,
+// while a write that times out is.
+func TestInterruptedKeepsScore(test *testing.T) {
+
+	conf := NewDefaultConfig(func(peer.ID) (time.Duration, error) {
+		return 0, errors.New("unreachable")
+	})
+	ss := NewWithConfig(conf)
+	defer ss.Shutdown()
+
+	pid := randomPeer(test)
+	if !ss.Add(pid, &bufferStream{}, false) {
+		test.Fatal("Cannot add", pid, "to stream store")
+	}
+	fail := func(err error) {
+		result := ss.ApplyContext(context.Background(), func(peer.ID, io.Writer) error {
+			return err
+		}, nil)
+		if outcome := result[pid]; outcome.Err != err {
+			test.Fatal("Wrong outcome!", outcome)
+		}
+	}
+
+	// Verify that an interrupted transaction leaves the score alone.
+	score := ss.Score(pid)
+	fail(errors.New("Artifact transfer was interrupted"))
+	if ss.Score(pid) != score {
+		test.Fatal("Interrupted transaction lowered the score!", score, ss.Score(pid))
+	}
+
+	// Verify that a timeout lowers it.
+	fail(util.ErrTimeout)
+	if ss.Score(pid) >= score {
+		test.Fatal("Timeout did not lower the score!", score, ss.Score(pid))
+	}
+
+}
+
+// Show that a request to a stalled peer gives up by the write timeout.
+func TestRequestStalled(test *testing.T) {
+
+	conf := NewDefaultConfig(randomProbe)
+	conf.WriteTimeout = 50 * time.Millisecond
+	ss := NewWithConfig(conf)
+	defer ss.Shutdown()
+
+	pid := randomPeer(test)
+	stream := newClosingStream()
+	defer close(stream.release)
+	if !ss.Add(pid, stream, false) || !ss.AddControl(pid, stream) {
+		test.Fatal("Cannot add", pid, "to stream store")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := ss.Request(context.Background(), pid, []byte("hello"))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != util.ErrTimeout {
+			test.Fatal("Wrong error!", err)
+		}
+	case <-time.After(time.Second):
+		test.Fatal("Request to a stalled peer did not give up!")
+	}
+
+}
+
+// Show that replacing the stream of a peer fails the requests sent over the
+// old one.
+func TestRequestReplaced(test *testing.T) {
+
+	ss := NewWithConfig(NewDefaultConfig(randomProbe))
+	defer ss.Shutdown()
+
+	pid := randomPeer(test)
+	stream := &bufferStream{}
+	if !ss.Add(pid, stream, false) {
+		test.Fatal("Cannot add", pid, "to stream store")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := ss.Request(context.Background(), pid, []byte("hello"))
+		done <- err
+	}()
+
+	// Wait for the request to be sent, then replace the stream.
+	for i := 0; ; i++ {
+		stream.Lock()
+		sent := stream.buffer.Len() > 0
+		stream.Unlock()
+		if sent {
+			break
+		}
+		if i == 100 {
+			test.Fatal("Request was not sent!")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !ss.Add(pid, &bufferStream{}, false) {
+		test.Fatal("Cannot replace the stream of", pid)
+	}
+	select {
+	case err := <-done:
+		if err != ErrNotPaired {
+			test.Fatal("Wrong error!", err)
+		}
+	case <-time.After(time.Second):
+		test.Fatal("Request over the old stream was not failed!")
+	}
+
+}
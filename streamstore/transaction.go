@@ -0,0 +1,134 @@
+/**
+ * File        : transaction.go
+ * Description : Context-scoped stream store transactions.
+ * Copyright   : Copyright (c) 2017-2018 DFINITY Stiftung. All rights reserved.
+ * Maintainer  : Enzo Haussecker <enzo@dfinity.org>
+ * Stability   : Stable
+ */
+
+package streamstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
+
+	"github.com/dfinity/go-revolver/routingtable"
+)
+
+// ErrQueueFull is reported for a peer whose transaction queue is full.  Unlike
+// other errors, it does not mean that anything is wrong with the stream.
+var ErrQueueFull = errors.New("transaction queue is full")
+
+// Outcome is the result of a transaction for a single peer.
+type Outcome struct {
+	// The error returned by the transaction, ErrQueueFull if the transaction
+	// could not be queued, or the error of the context if the transaction was
+	// cancelled.
+	Err error
+
+	// The time spent running the transaction, excluding the time spent in
+	// the queue.
+	Duration time.Duration
+
+	// The number of bytes written to the stream.  This may be non-zero for a
+	// cancelled transaction that was interrupted while running.
+	Bytes int64
+}
+
+// Result is the result of a transaction for each peer it was applied to.
+type Result map[peer.ID]Outcome
+
+func newTransaction(ctx context.Context, f func(peer.ID, io.Writer) error) transaction {
+	return transaction{
+		false,
+		ctx,
+		f,
+		make(map[peer.ID]chan error),
+		make(map[peer.ID]Outcome),
+		make(map[peer.ID]*txQueue),
+		&sync.Mutex{},
+	}
+}
+
+// A writer that counts bytes and refuses to write once its context is done.
+type txWriter struct {
+	ctx    context.Context
+	writer io.Writer
+	bytes  int64
+}
+
+func (w *txWriter) Write(data []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := w.writer.Write(data)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Run a transaction on the stream of a peer.  Cancelled transactions are
+// dropped without touching the stream.
+func (ss *streamstore) process(pid peer.ID, ctx *peerctx, stream io.Writer, tx transaction) Outcome {
+	if err := tx.ctx.Err(); err != nil {
+		ss.Debug("Dropping cancelled transaction for", pid)
+		return Outcome{Err: err}
+	}
+	ss.Debug("Processing transaction for", pid)
+	start := time.Now()
+	writer := &txWriter{ctx: tx.ctx, writer: stream}
+	err := tx.query(pid, writer)
+	atomic.StoreInt64(&ctx.lastWrite, time.Now().UnixNano())
+	// Only a write that timed out is held against the peer.  A transaction
+	// that the caller cancelled or that failed on its own says nothing about
+	// the peer.
+	switch {
+	case err == nil:
+		ss.routingTable.Observe(pid, routingtable.Delivered)
+	case err != tx.ctx.Err() && isTimeout(err):
+		ss.routingTable.Observe(pid, routingtable.Timeout)
+	}
+	return Outcome{err, time.Since(start), writer.bytes}
+}
+
+// Check if an error reports a timeout, as the deadline errors of a network
+// connection do.
+func isTimeout(err error) bool {
+	timeout, ok := err.(interface {
+		Timeout() bool
+	})
+	return ok && timeout.Timeout()
+}
+
+func (ss *streamstore) ApplyContext(ctx context.Context, f func(peer.ID, io.Writer) error, exclude peer.IDSlice) Result {
+	count := int(math.Sqrt(float64(ss.InboundCapacity() + ss.OutboundCapacity())))
+	pids := ss.routingTable.Recommend(count, exclude)
+	tx := newTransaction(ctx, f)
+	results := ss.apply(tx, exclude, pids)
+
+	// Once the context is done, take the transaction out of the queues where
+	// it has not started yet.  Wait for the others to finish, which they do
+	// quickly, since their writers refuse to write.
+	result := make(Result)
+	for pid, c := range results {
+		select {
+		case <-c:
+		case <-ctx.Done():
+			if queue, exists := tx.queues[pid]; exists && queue.remove(tx) {
+				result[pid] = Outcome{Err: ctx.Err()}
+				continue
+			}
+			<-c
+		}
+		tx.Lock()
+		result[pid] = tx.outcomes[pid]
+		tx.Unlock()
+	}
+	return result
+}
@@ -12,11 +12,20 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
-	"errors"
 	"io"
 	"time"
 )
 
+// ErrTimeout is returned when a read or write does not complete in time. Like
+// the deadline errors of a network connection, it reports itself as a timeout.
+var ErrTimeout error = timeoutError{}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "Timeout!" }
+func (timeoutError) Temporary() bool { return true }
+func (timeoutError) Timeout() bool   { return true }
+
 // Write data to a stream using a timeout.
 func WriteWithTimeout(writer io.Writer, data []byte, timeout time.Duration) error {
 	result := make(chan error, 1)
@@ -29,7 +38,7 @@ func WriteWithTimeout(writer io.Writer, data []byte, timeout time.Duration) erro
 		return err
 	case <-time.After(timeout):
 		select {
-		case result <- errors.New("Timeout!"):
+		case result <- ErrTimeout:
 		default:
 		}
 		err := <-result
@@ -50,7 +59,7 @@ func ReadWithTimeout(reader io.Reader, n uint32, timeout time.Duration) ([]byte,
 		return data, err
 	case <-time.After(timeout):
 		select {
-		case result <- errors.New("Timeout!"):
+		case result <- ErrTimeout:
 		default:
 		}
 		err := <-result
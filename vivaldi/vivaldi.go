@@ -0,0 +1,302 @@
+/**
+ * File        : vivaldi.go
+ * Description : Synthetic network coordinates for latency estimation.
+ * Copyright   : Copyright (c) 2017-2018 DFINITY Stiftung. All rights reserved.
+ * Maintainer  : Enzo Haussecker <enzo@dfinity.org>
+ * Stability   : Experimental
+ */
+
+package vivaldi
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru"
+	"gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
+)
+
+// Dimensions is the number of dimensions of the Euclidean part of a
+// coordinate.
+const Dimensions = 3
+
+// EncodedSize is the size of an encoded coordinate in bytes.
+const EncodedSize = 8 * (Dimensions + 2)
+
+// The largest error estimate, which is also the error estimate of a new node
+// and of a coordinate relayed by a third party.
+const maxError = 1.5
+
+// The smallest error estimate that a remote node may claim, so that no single
+// node can dominate the update of another.
+const minError = 0.05
+
+// The largest absolute value of any component of a coordinate in seconds,
+// which is far beyond any real round-trip time.
+const maxMagnitude = 10.0
+
+// Coordinate is a position in a synthetic network space.  The estimated
+// latency between two nodes is the Euclidean distance between their vectors
+// plus both heights, which model the access links of the nodes.  All values
+// are in seconds, except the error, which is relative.
+type Coordinate struct {
+	Vec    []float64
+	Height float64
+	Error  float64
+}
+
+// Config configures a coordinate system.
+type Config struct {
+	// The tuning constants for the error estimate and the coordinate.
+	Ce float64
+	Cc float64
+
+	// The smallest height of a coordinate in seconds.
+	MinHeight float64
+
+	// The number of remote coordinates that are remembered.
+	HistorySize int
+}
+
+// A remote coordinate, and whether a third party relayed it.
+type remoteCoordinate struct {
+	coord   Coordinate
+	relayed bool
+}
+
+// System maintains the coordinate of the local node and those of remote
+// nodes.  It is safe for concurrent use.
+type System struct {
+	conf   Config
+	local  Coordinate
+	remote *lru.Cache
+	sync.Mutex
+}
+
+// NewDefaultConfig creates a Config with default parameters.
+func NewDefaultConfig() Config {
+	return Config{
+		Ce:          0.25,
+		Cc:          0.25,
+		MinHeight:   10e-6,
+		HistorySize: 4096,
+	}
+}
+
+// New creates a coordinate system with the given config.
+func New(conf Config) *System {
+	remote, err := lru.New(conf.HistorySize)
+	if err != nil {
+		remote, _ = lru.New(4096)
+	}
+	return &System{
+		conf: conf,
+		local: Coordinate{
+			Vec:    make([]float64, Dimensions),
+			Height: conf.MinHeight,
+			Error:  maxError,
+		},
+		remote: remote,
+	}
+}
+
+// Coordinate returns a copy of the coordinate of the local node.
+func (s *System) Coordinate() Coordinate {
+	s.Lock()
+	defer s.Unlock()
+	return s.local.clone()
+}
+
+// Observe records the coordinate that a remote node reports about itself.
+// Invalid coordinates are ignored.
+func (s *System) Observe(pid peer.ID, coord Coordinate) {
+	if !coord.valid() {
+		return
+	}
+	coord = coord.clone()
+	coord.Error = math.Min(math.Max(coord.Error, minError), maxError)
+	s.Lock()
+	defer s.Unlock()
+	s.remote.Add(pid, remoteCoordinate{coord, false})
+}
+
+// ObserveRelayed records the coordinate of a remote node that a third party
+// reports.  It never replaces a coordinate that the node reported itself, and
+// gets the largest error estimate, so that it carries the least weight.
+// Invalid coordinates are ignored.
+func (s *System) ObserveRelayed(pid peer.ID, coord Coordinate) {
+	if !coord.valid() {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	if value, exists := s.remote.Peek(pid); exists && !value.(remoteCoordinate).relayed {
+		return
+	}
+	coord = coord.clone()
+	coord.Error = maxError
+	s.remote.Add(pid, remoteCoordinate{coord, true})
+}
+
+// Lookup returns a copy of the coordinate of a remote node, if known.
+func (s *System) Lookup(pid peer.ID) (Coordinate, bool) {
+	value, exists := s.remote.Peek(pid)
+	if !exists {
+		return Coordinate{}, false
+	}
+	return value.(remoteCoordinate).coord.clone(), true
+}
+
+// Forget the coordinate of a remote node.
+func (s *System) Forget(pid peer.ID) {
+	s.remote.Remove(pid)
+}
+
+// Update the coordinate of the local node given a round-trip time to a remote
+// node whose coordinate is known.  It returns false if the coordinate of the
+// remote node is unknown.
+func (s *System) Update(pid peer.ID, rtt time.Duration) bool {
+	value, exists := s.remote.Get(pid)
+	if !exists || rtt <= 0 {
+		return false
+	}
+	remote := value.(remoteCoordinate).coord
+
+	s.Lock()
+	defer s.Unlock()
+
+	// Weigh the sample by how confident both nodes are.
+	sample := rtt.Seconds()
+	dist := distance(s.local, remote)
+	remoteError := math.Min(math.Max(remote.Error, minError), maxError)
+	weight := s.local.Error / (s.local.Error + remoteError)
+	relative := math.Abs(dist-sample) / sample
+	s.local.Error = math.Min(relative*s.conf.Ce*weight+s.local.Error*(1-s.conf.Ce*weight), maxError)
+
+	// Move the coordinate along the force of the spring between the nodes,
+	// but never further than the measured round-trip time.
+	force := clamp(s.conf.Cc*weight*(sample-dist), sample)
+	unit, norm := direction(s.local.Vec, remote.Vec)
+	for i := range s.local.Vec {
+		s.local.Vec[i] = clamp(s.local.Vec[i]+unit[i]*force, maxMagnitude)
+	}
+	if norm > 0 {
+		s.local.Height += clamp((s.local.Height+remote.Height)*force/norm, math.Abs(force))
+	}
+	s.local.Height = math.Min(math.Max(s.local.Height, s.conf.MinHeight), maxMagnitude)
+	return true
+}
+
+// Estimate the round-trip time to a remote node whose coordinate is known.
+func (s *System) Estimate(pid peer.ID) (time.Duration, bool) {
+	value, exists := s.remote.Peek(pid)
+	if !exists {
+		return 0, false
+	}
+	local := s.Coordinate()
+	return Distance(local, value.(remoteCoordinate).coord), true
+}
+
+// Distance estimates the round-trip time between two coordinates.
+func Distance(a, b Coordinate) time.Duration {
+	return time.Duration(distance(a, b) * float64(time.Second))
+}
+
+func distance(a, b Coordinate) float64 {
+	var sum float64
+	for i := range a.Vec {
+		d := a.Vec[i] - b.Vec[i]
+		sum += d * d
+	}
+	return math.Sqrt(sum) + a.Height + b.Height
+}
+
+// Get the unit vector from b to a and the distance between them.  Coincident
+// nodes are pushed apart in a random direction.
+func direction(a, b []float64) ([]float64, float64) {
+	unit := make([]float64, len(a))
+	var norm float64
+	for i := range a {
+		unit[i] = a[i] - b[i]
+		norm += unit[i] * unit[i]
+	}
+	norm = math.Sqrt(norm)
+	if norm > 1e-9 {
+		for i := range unit {
+			unit[i] /= norm
+		}
+		return unit, norm
+	}
+	var random float64
+	for i := range unit {
+		unit[i] = rand.Float64() - 0.5
+		random += unit[i] * unit[i]
+	}
+	random = math.Sqrt(random)
+	for i := range unit {
+		unit[i] /= random
+	}
+	return unit, 0
+}
+
+// Limit a value to the range [-limit, limit].
+func clamp(x, limit float64) float64 {
+	return math.Max(-limit, math.Min(x, limit))
+}
+
+func (c Coordinate) clone() Coordinate {
+	vec := make([]float64, len(c.Vec))
+	copy(vec, c.Vec)
+	return Coordinate{vec, c.Height, c.Error}
+}
+
+func (c Coordinate) valid() bool {
+	if len(c.Vec) != Dimensions {
+		return false
+	}
+	sane := func(x float64) bool {
+		return !math.IsNaN(x) && math.Abs(x) <= maxMagnitude
+	}
+	for _, x := range c.Vec {
+		if !sane(x) {
+			return false
+		}
+	}
+	return sane(c.Height) && sane(c.Error) && c.Height >= 0 && c.Error > 0
+}
+
+// Encode a coordinate.
+func (c Coordinate) Encode() []byte {
+	data := make([]byte, EncodedSize)
+	for i := 0; i < Dimensions; i++ {
+		var x float64
+		if i < len(c.Vec) {
+			x = c.Vec[i]
+		}
+		binary.BigEndian.PutUint64(data[8*i:], math.Float64bits(x))
+	}
+	binary.BigEndian.PutUint64(data[8*Dimensions:], math.Float64bits(c.Height))
+	binary.BigEndian.PutUint64(data[8*Dimensions+8:], math.Float64bits(c.Error))
+	return data
+}
+
+// Decode a coordinate.
+func Decode(data []byte) (Coordinate, error) {
+	if len(data) != EncodedSize {
+		return Coordinate{}, errors.New("Invalid coordinate size")
+	}
+	c := Coordinate{Vec: make([]float64, Dimensions)}
+	for i := 0; i < Dimensions; i++ {
+		c.Vec[i] = math.Float64frombits(binary.BigEndian.Uint64(data[8*i:]))
+	}
+	c.Height = math.Float64frombits(binary.BigEndian.Uint64(data[8*Dimensions:]))
+	c.Error = math.Float64frombits(binary.BigEndian.Uint64(data[8*Dimensions+8:]))
+	if !c.valid() {
+		return Coordinate{}, errors.New("Invalid coordinate")
+	}
+	return c, nil
+}
@@ -0,0 +1,162 @@
+/**
+ * File        : vivaldi_test.go
+ * Description : Unit tests.
+ * Copyright   : Copyright (c) 2017-2018 DFINITY Stiftung. All rights reserved.
+ * Maintainer  : Enzo Haussecker <enzo@dfinity.org>
+ * Stability   : Experimental
+ */
+
+package vivaldi
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
+)
+
+// Show that nodes on a plane learn coordinates that predict their latencies.
+func TestConvergence(test *testing.T) {
+
+	const N = 32
+
+	// Place the nodes at random points on a plane, where the distance between
+	// two points is the round-trip time in milliseconds.
+	rand.Seed(0)
+	x := make([]float64, N)
+	y := make([]float64, N)
+	pids := make([]peer.ID, N)
+	systems := make([]*System, N)
+	for i := range systems {
+		x[i] = 200 * rand.Float64()
+		y[i] = 200 * rand.Float64()
+		pids[i] = peer.ID(fmt.Sprintf("node-%d", i))
+		systems[i] = New(NewDefaultConfig())
+	}
+	rtt := func(i, j int) time.Duration {
+		return time.Duration(math.Hypot(x[i]-x[j], y[i]-y[j])*float64(time.Millisecond)) + time.Millisecond
+	}
+
+	// Let random pairs of nodes ping each other.
+	for round := 0; round < 20000; round++ {
+		i, j := rand.Intn(N), rand.Intn(N)
+		if i == j {
+			continue
+		}
+		systems[i].Observe(pids[j], systems[j].Coordinate())
+		systems[i].Update(pids[j], rtt(i, j))
+	}
+
+	// Verify that the median relative error is small.
+	var errors []float64
+	for i := 0; i < N; i++ {
+		for j := 0; j < N; j++ {
+			if i == j {
+				continue
+			}
+			systems[i].Observe(pids[j], systems[j].Coordinate())
+			estimate, ok := systems[i].Estimate(pids[j])
+			if !ok {
+				test.Fatal("Missing estimate")
+			}
+			actual := rtt(i, j)
+			errors = append(errors, math.Abs(float64(estimate-actual))/float64(actual))
+		}
+	}
+	sort.Float64s(errors)
+	if median := errors[len(errors)/2]; median > 0.2 {
+		test.Fatal("Median relative error is too large:", median)
+	}
+
+}
+
+// Show that a coordinate survives encoding and that invalid coordinates are
+// rejected.
+func TestEncoding(test *testing.T) {
+
+	coord := Coordinate{Vec: []float64{0.1, -0.2, 0.3}, Height: 0.01, Error: 0.5}
+	decoded, err := Decode(coord.Encode())
+	if err != nil {
+		test.Fatal(err)
+	}
+	if !reflect.DeepEqual(coord, decoded) {
+		test.Fatal("Corrupt coordinate!", decoded)
+	}
+
+	coord.Height = math.NaN()
+	if _, err := Decode(coord.Encode()); err == nil {
+		test.Fatal("Accepted an invalid coordinate")
+	}
+
+}
+
+// Show that a relayed coordinate carries the largest error estimate and never
+// replaces a coordinate that a node reported itself.
+func TestRelayed(test *testing.T) {
+
+	system := New(NewDefaultConfig())
+	pid := peer.ID("node")
+
+	relayed := Coordinate{Vec: []float64{0.1, 0, 0}, Height: 0.01, Error: 0.01}
+	system.ObserveRelayed(pid, relayed)
+	coord, ok := system.Lookup(pid)
+	if !ok {
+		test.Fatal("Missing coordinate")
+	}
+	if coord.Error != maxError {
+		test.Fatal("Relayed coordinate is not down-weighted:", coord.Error)
+	}
+
+	own := Coordinate{Vec: []float64{0.2, 0, 0}, Height: 0.01, Error: 0.5}
+	system.Observe(pid, own)
+	system.ObserveRelayed(pid, relayed)
+	coord, _ = system.Lookup(pid)
+	if !reflect.DeepEqual(coord, own) {
+		test.Fatal("Relayed coordinate replaced a reported one:", coord)
+	}
+
+}
+
+// Show that a remote node can neither inject an absurd coordinate nor drag the
+// local coordinate further than the measured round-trip time.
+func TestSanity(test *testing.T) {
+
+	system := New(NewDefaultConfig())
+	pid := peer.ID("node")
+
+	system.Observe(pid, Coordinate{Vec: []float64{1e9, 0, 0}, Height: 0.01, Error: 0.5})
+	if _, ok := system.Lookup(pid); ok {
+		test.Fatal("Accepted an absurd coordinate")
+	}
+
+	system.Observe(pid, Coordinate{Vec: []float64{maxMagnitude, 0, 0}, Height: 0, Error: 1e-9})
+	coord, _ := system.Lookup(pid)
+	if coord.Error != minError {
+		test.Fatal("Remote error is not clamped:", coord.Error)
+	}
+
+	rtt := 50 * time.Millisecond
+	for i := 0; i < 100; i++ {
+		before := system.Coordinate()
+		system.Update(pid, rtt)
+		after := system.Coordinate()
+		moved := 0.0
+		for j := range after.Vec {
+			moved += math.Pow(after.Vec[j]-before.Vec[j], 2)
+		}
+		if limit := rtt.Seconds() + 1e-9; math.Sqrt(moved) > limit || math.Abs(after.Height-before.Height) > limit {
+			test.Fatal("Moved too far:", before, after)
+		}
+		for _, x := range after.Vec {
+			if math.Abs(x) > maxMagnitude {
+				test.Fatal("Coordinate is out of bounds:", after)
+			}
+		}
+	}
+
+}